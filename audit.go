@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gswilcox01/go-rollback/rollback"
+)
+
+var auditLog string
+
+// auditEntry is one line of the --audit-log file, recorded for each file
+// rolled back.
+type auditEntry struct {
+	Time   string `json:"time"`
+	User   string `json:"user,omitempty"`
+	Branch string `json:"branch,omitempty"`
+	File   string `json:"file"`
+	// FromCommit is HEAD when the run started, so the file's content before
+	// the rollback; ToCommit is the commit it was rolled back to, and
+	// NewCommit the commit recording the rollback. All are full hashes.
+	FromCommit string `json:"from_commit"`
+	ToCommit   string `json:"to_commit"`
+	NewCommit  string `json:"new_commit,omitempty"`
+}
+
+var audit struct {
+	mu   sync.Mutex
+	file *os.File
+	head string
+	user string
+	err  error
+}
+
+// openAuditLog opens --audit-log for appending, creating it if needed, before
+// anything is rolled back, so a log that can't be written stops the run
+// rather than leaving rollbacks unrecorded.
+func openAuditLog() error {
+	if auditLog == "" || opts.DryRun {
+		return nil
+	}
+	head, err := rollback.ResolveRef("HEAD", opts)
+	if err != nil {
+		return err
+	}
+	user, err := rollback.User(opts)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open the audit log: %v", err)
+	}
+	audit.file, audit.head, audit.user = file, head.FullHash, user
+
+	return nil
+}
+
+// auditRollback appends a line for a file rolled back to the audit log. Each
+// line is a single write to a file opened for appending, so lines from
+// concurrent rollbacks, or other runs, are never interleaved. A failure is
+// reported at once and fails the run once it ends.
+func auditRollback(outcome fileOutcome) {
+	if audit.file == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:       time.Now().UTC().Format(time.RFC3339),
+		User:       audit.user,
+		Branch:     currentBranch,
+		File:       outcome.File,
+		FromCommit: audit.head,
+		ToCommit:   outcome.Commit,
+		NewCommit:  outcome.NewCommit,
+	}
+	// The outcome has the hashes as displayed, possibly abbreviated.
+	for _, hash := range []*string{&entry.ToCommit, &entry.NewCommit} {
+		if *hash == "" {
+			continue
+		}
+		if resolved, err := rollback.ResolveRef(*hash, opts); err == nil {
+			*hash = resolved.FullHash
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		audit.mu.Lock()
+		_, err = audit.file.Write(append(line, '\n'))
+		audit.mu.Unlock()
+	}
+	if err != nil {
+		err = fmt.Errorf("failed to write the audit log for '%s': %v", outcome.File, err)
+		fmt.Fprintln(os.Stderr, errorColor.Sprint("Error:"), err)
+		audit.mu.Lock()
+		if audit.err == nil {
+			audit.err = err
+		}
+		audit.mu.Unlock()
+	}
+}
+
+// closeAuditLog closes the audit log, returning the first error writing it.
+func closeAuditLog() error {
+	if audit.file == nil {
+		return nil
+	}
+	err := audit.file.Close()
+	audit.file = nil
+	if audit.err != nil {
+		return audit.err
+	}
+	if err != nil {
+		return fmt.Errorf("failed to close the audit log: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/fatih/color"
+	"github.com/gswilcox01/go-rollback/rollback"
+)
+
+var colorMode string
+
+var (
+	hashColor    = color.New(color.FgYellow)
+	dateColor    = color.New(color.Faint)
+	successColor = color.New(color.FgGreen)
+	errorColor   = color.New(color.FgRed, color.Bold)
+)
+
+// applyColorMode resolves --color. In auto mode color stays enabled only
+// when stdout is a terminal and NO_COLOR isn't set; --no-color is the same
+// as --color never.
+func applyColorMode() error {
+	switch colorMode {
+	case "auto":
+	case "always":
+		// Colors created while NO_COLOR is set stay disabled unless
+		// re-enabled individually.
+		color.NoColor = false
+		for _, c := range []*color.Color{hashColor, dateColor, successColor, errorColor} {
+			c.EnableColor()
+		}
+	case "never":
+		color.NoColor = true
+	default:
+		return usageErrorf("invalid --color '%s': must be 'auto', 'always' or 'never'", colorMode)
+	}
+	if opts.NoColor {
+		color.NoColor = true
+	}
+	opts.NoColor = color.NoColor
+
+	return nil
+}
+
+// formatEntry renders a history entry like CommitEntry.String, with the hash
+// (full with --full-hash) highlighted and the date dimmed, or as --format
+// rendered it.
+func formatEntry(e rollback.CommitEntry) string {
+	if e.Formatted != "" {
+		return e.Formatted
+	}
+	return fmt.Sprintf("%s, %s, %s, %s", hashColor.Sprint(entryHash(e)), e.Author, dateColor.Sprint(e.Date), e.Subject)
+}
+
+// successf is infof for a line reporting that something succeeded; the
+// newline is added after the color is reset.
+func successf(format string, args ...any) {
+	infof("%s\n", successColor.Sprintf(format, args...))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// configFileName is looked up in the working directory and its parents when
+// --config isn't given.
+const configFileName = ".rollback.yaml"
+
+// configKeyAliases maps config keys that read more naturally as plurals to
+// their flag names.
+var configKeyAliases = map[string]string{
+	"protected-branches": "protected-branch",
+	"filenames":          "filename",
+}
+
+var configPath string
+
+// envPrefix starts the environment variables that set flags, e.g.
+// ROLLBACK_LIMIT for --limit.
+const envPrefix = "ROLLBACK_"
+
+// envFlags are the flags that ROLLBACK_* environment variables can set:
+// settings a deployment fixes, not what a single run rolls back. Leaving out
+// flags such as --commit also keeps a nested run from picking up
+// ROLLBACK_COMMIT, which --post-rollback-cmd and --on-complete export.
+var envFlags = map[string]bool{
+	"allow-detached": true, "allow-git-prompts": true, "audit-log": true,
+	"author": true, "color": true, "commit-per-dir": true, "committer": true,
+	"dry-run": true, "exclude": true, "filename": true, "first-parent": true,
+	"follow-symlinks": true, "format": true, "full-hash": true,
+	"gpg-key": true, "include": true, "include-merges": true, "jobs": true,
+	"keep-going": true, "limit": true, "log-format": true, "log-level": true,
+	"max-depth": true, "max-files": true, "message": true, "no-color": true,
+	"no-default-protected": true, "no-pager": true, "no-tui": true,
+	"no-verify": true, "notify-on": true, "notify-webhook": true,
+	"open-pr": true, "output": true, "protected-branch": true, "push": true,
+	"quiet": true, "remote": true, "repo": true, "retries": true,
+	"sign": true, "single-commit": true, "stash": true, "strategy": true,
+	"timeout": true, "trailer": true, "validate-yaml": true,
+	"verbose": true, "wait-lock": true, "yes": true,
+}
+
+// loadEnv applies ROLLBACK_* environment variables to the envFlags that
+// weren't set on the command line. It runs before loadConfig and marks the
+// flags it sets as changed, so the environment takes precedence over the
+// config file. Lists, such as ROLLBACK_PROTECTED_BRANCHES, are
+// comma-separated.
+func loadEnv(cmd *cobra.Command) error {
+	for _, env := range os.Environ() {
+		key, value, _ := strings.Cut(env, "=")
+		name, ok := strings.CutPrefix(key, envPrefix)
+		if !ok {
+			continue
+		}
+		name = strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+		if alias, ok := configKeyAliases[name]; ok {
+			name = alias
+		}
+		flag := cmd.Flags().Lookup(name)
+		if !envFlags[name] || flag == nil || flag.Changed {
+			continue
+		}
+		values := []string{value}
+		if t := flag.Value.Type(); t == "stringArray" || t == "stringSlice" {
+			values = strings.Split(value, ",")
+		}
+		for _, v := range values {
+			if err := cmd.Flags().Set(name, strings.TrimSpace(v)); err != nil {
+				return usageErrorf("invalid value for %s: %v", key, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// findConfigFile walks up from the working directory looking for
+// configFileName. It returns "" if there is none.
+func findConfigFile() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		candidate := filepath.Join(dir, configFileName)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// loadConfig applies the config file's values to every flag that wasn't set
+// on the command line. Keys are flag names, e.g. "limit" or "message".
+func loadConfig(cmd *cobra.Command) error {
+	path := configPath
+	if path == "" {
+		found, err := findConfigFile()
+		if err != nil {
+			return fmt.Errorf("failed to look for %s: %v", configFileName, err)
+		}
+		if found == "" {
+			return nil
+		}
+		path = found
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return usageErrorf("failed to read config file: %v", err)
+	}
+	var values map[string]any
+	if err := yaml.Unmarshal(data, &values); err != nil {
+		return usageErrorf("failed to parse config file '%s': %v", path, err)
+	}
+
+	for key, value := range values {
+		name := key
+		if alias, ok := configKeyAliases[key]; ok {
+			name = alias
+		}
+		flag := cmd.Flags().Lookup(name)
+		if flag == nil || name == "config" {
+			return usageErrorf("unknown key '%s' in config file '%s'", key, path)
+		}
+		if flag.Changed {
+			continue
+		}
+		if err := setFlagFromConfig(flag, value); err != nil {
+			return usageErrorf("invalid value for '%s' in config file '%s': %v", key, path, err)
+		}
+	}
+
+	return nil
+}
+
+func setFlagFromConfig(flag *pflag.Flag, value any) error {
+	list, isList := value.([]any)
+	if !isList {
+		return flag.Value.Set(fmt.Sprint(value))
+	}
+	for _, item := range list {
+		if err := flag.Value.Set(fmt.Sprint(item)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
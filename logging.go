@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+)
+
+var (
+	logLevel  string
+	logFormat string
+
+	// logger receives structured logs; it discards them unless --log-level
+	// is set.
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+)
+
+// setupLogger builds the logger from --log-level and --log-format and hands
+// it to the rollback package for git command logs.
+func setupLogger() error {
+	if logFormat != "text" && logFormat != "json" {
+		return usageErrorf("invalid --log-format '%s': must be 'text' or 'json'", logFormat)
+	}
+	if logLevel == "" {
+		return nil
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(logLevel)); err != nil {
+		return usageErrorf("invalid --log-level '%s': must be debug, info, warn or error", logLevel)
+	}
+	handlerOpts := &slog.HandlerOptions{Level: level}
+	if logFormat == "json" {
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, handlerOpts))
+	} else {
+		logger = slog.New(slog.NewTextHandler(os.Stderr, handlerOpts))
+	}
+	opts.Logger = logger
+
+	return nil
+}
@@ -2,200 +2,1590 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
+	"github.com/gswilcox01/go-rollback/rollback"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"golang.org/x/term"
 )
 
-func isGitRepo() (bool, string, error) {
-	cmd := exec.Command("git", "rev-parse", "--is-inside-work-tree")
-	cmd.Stderr = nil
-	out, err := cmd.Output()
+var (
+	opts rollback.Options
+
+	assumeYes     bool
+	targetCommit  string
+	rollbackSteps int
+	defaultStep   int
+	singleCommit  bool
+	commitPerDir  bool
+	toLastTag     bool
+	includeMerges bool
+	trailers      []string
+	showDiffs     bool
+	outputFormat  string
+	verbose       bool
+	quiet         bool
+	jobs          int
+
+	interactiveEach bool
+	assumeContinue  bool
+	pushRollback    bool
+	remoteName      string
+	rollbackBranch  string
+	autoBranch      bool
+	openPR          bool
+	tagName         string
+	forceTag        bool
+	fullHash        bool
+	fromFile        string
+	keepGoing       bool
+	targetRef       string
+	authorFilter    string
+	baseCommit      string
+	changedBetween  string
+	changedTo       string
+	deleteMissing   bool
+	restoreDeleted  bool
+	maxFiles        int
+
+	// authorPattern is the compiled --author-filter, which selects authors
+	// that don't match when excludeAuthor is set.
+	authorPattern *regexp.Regexp
+	excludeAuthor bool
+
+	// repo is the repository found at startup, and histories the history of
+	// each file planned, as BuildPlan read it.
+	repo      rollback.Repo
+	histories map[string][]rollback.CommitEntry
+
+	// currentBranch is the branch rollbacks are committed to; it changes once
+	// --branch has been created.
+	currentBranch string
+	branchCreated bool
+	// rolledBack records the files rolled back, or that a dry run would
+	// roll back, for --tag and --open-pr.
+	rolledBack []rollback.FileRollback
+
+	// dryRunStat totals the diffstat of every file a dry run previews.
+	dryRunStat struct {
+		sync.Mutex
+		insertions, deletions int
+	}
+)
+
+// timestampFormat names generated branches and tags.
+const timestampFormat = "20060102-150405"
+
+// flagAliases maps alternative flag names to the flags they stand for.
+var flagAliases = map[string]string{
+	"prune": "delete-missing",
+}
+
+// Build information, set at link time with e.g.
+//
+//	go build -ldflags "-X main.buildVersion=v1.2.3 -X main.buildCommit=$(git rev-parse --short HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	buildVersion = "dev"
+	buildCommit  = "none"
+	buildDate    = "unknown"
+)
+
+func versionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", buildVersion, buildCommit, buildDate)
+}
+
+// Exit codes returned by the command.
+const (
+	exitFailure = 1 // a git operation failed
+	exitUsage   = 2 // invalid flags, arguments or input
+	exitAborted = 3 // the user declined a confirmation
+)
+
+// exitError carries the exit code main should use for an error.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string { return e.err.Error() }
+
+func usageErrorf(format string, args ...any) error {
+	return &exitError{code: exitUsage, err: fmt.Errorf(format, args...)}
+}
+
+// usageArgs makes argument validation failures exit with exitUsage.
+func usageArgs(validate cobra.PositionalArgs) cobra.PositionalArgs {
+	return func(cmd *cobra.Command, args []string) error {
+		if err := validate(cmd, args); err != nil {
+			return usageErrorf("%v", err)
+		}
+		return nil
+	}
+}
+
+var errAborted = &exitError{code: exitAborted, err: errors.New("operation aborted by the user")}
+
+func exitCode(err error) int {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return exitFailure
+}
+
+// stdin is shared by every prompt so input typed ahead isn't lost in the
+// buffer of a discarded scanner.
+var stdin = bufio.NewScanner(os.Stdin)
+
+// stdinIsTerminal is whether prompts can be answered. Without a terminal,
+// such as in CI, a prompt could wait forever on a pipe nobody writes to.
+var stdinIsTerminal = term.IsTerminal(int(os.Stdin.Fd()))
+
+var errNoInput = &exitError{code: exitUsage, err: errors.New("no input available; pass --yes or --commit to run non-interactively")}
+
+var errNoTTY = &exitError{code: exitUsage, err: errors.New("no TTY to prompt on; pass --yes or --commit to run non-interactively")}
+
+// readLine reads the next line of input, failing with errNoTTY if stdin isn't
+// a terminal, and with errNoInput once it is closed, rather than letting
+// callers treat EOF as an empty answer.
+func readLine() (string, error) {
+	if !stdinIsTerminal {
+		fmt.Fprintln(infoOutput())
+		return "", errNoTTY
+	}
+	if !stdin.Scan() {
+		fmt.Fprintln(infoOutput())
+		if err := stdin.Err(); err != nil {
+			return "", fmt.Errorf("failed to read input: %v", err)
+		}
+		return "", errNoInput
+	}
+	return stdin.Text(), nil
+}
+
+// infoOutput is where informational output and prompts go: stdout, unless
+// --output json or yaml keeps it for the structured document alone.
+func infoOutput() io.Writer {
+	if outputFormat != "text" {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// infof prints informational output, which --quiet suppresses.
+func infof(format string, args ...any) {
+	if !quiet {
+		fmt.Fprintf(infoOutput(), format, args...)
+	}
+}
+
+// printHistory prints the file's history, as JSON or YAML with --output json
+// or yaml.
+func printHistory(filePath string, history []rollback.CommitEntry) error {
+	if outputFormat != "text" {
+		return printStructured(history)
+	}
+	listHistory(filePath, history)
+
+	return nil
+}
+
+// listHistory lists the file's history, numbered to choose a commit by.
+func listHistory(filePath string, history []rollback.CommitEntry) {
+	var listing strings.Builder
+	fmt.Fprintf(&listing, "\nGit history for '%s':\n", filePath)
+	width := len(strconv.Itoa(len(history)))
+	if width < 2 {
+		width = 2
+	}
+	for i, entry := range history {
+		fmt.Fprintf(&listing, "%*d. %s\n", width, i+1, formatEntry(entry))
+	}
+	if shouldPage(len(history) + 2) {
+		page(listing.String())
+	} else {
+		infof("%s", listing.String())
+	}
+}
+
+// entryHash is the hash shown for and used to roll back to an entry: the
+// abbreviated one unless --full-hash is set.
+func entryHash(e rollback.CommitEntry) string {
+	if fullHash {
+		return e.FullHash
+	}
+	return e.Hash
+}
+
+func selectCommitFromFlags(filePath string, history []rollback.CommitEntry) (string, error) {
+	switch {
+	case toLastTag:
+		tag, entry, err := rollback.LastTag(filePath, opts)
+		if err != nil {
+			return "", err
+		}
+		infof("Rolling '%s' back to its version at tag '%s' (%s).\n", filePath, tag, entryHash(entry))
+		return entryHash(entry), nil
+	case opts.Before != "":
+		if len(history) == 0 {
+			return "", fmt.Errorf("no commit in the file's history predates %s", opts.Before)
+		}
+		return entryHash(history[0]), nil
+	case authorPattern != nil:
+		for _, entry := range history {
+			if authorPattern.MatchString(entry.Author) != excludeAuthor {
+				return entryHash(entry), nil
+			}
+		}
+		return "", fmt.Errorf("no commit in the file's history has an author matching --author-filter '%s'", authorFilter)
+	case opts.Grep != "":
+		if len(history) == 0 {
+			return "", fmt.Errorf("no commit in the file's history matches '%s'", opts.Grep)
+		}
+		if len(history) == 1 {
+			return entryHash(history[0]), nil
+		}
+	}
+
+	return "", nil
+}
+
+// promptForCommit asks which listed commit to roll back to. When
+// firstIsCurrent is set, the first entry is the file's current version, so
+// the default is --default-step entries below it and choosing it leaves the
+// file alone. With picking, the commit is chosen with the arrow-key picker
+// instead. inDirectory is set when the file is one of several being rolled
+// back.
+func promptForCommit(filePath string, history []rollback.CommitEntry, firstIsCurrent bool, picking bool, inDirectory bool) (string, error) {
+	for {
+		defaultIndex := defaultStep + 1
+		if !firstIsCurrent {
+			defaultIndex = max(defaultStep, 1)
+		}
+		if len(history) < defaultIndex {
+			defaultIndex = len(history)
+		}
+		var index int
+		if picking {
+			var err error
+			index, err = pickCommit(filePath, history, defaultIndex)
+			if err != nil {
+				return "", err
+			}
+		} else {
+			var input string
+			if assumeYes {
+				infof("Selecting commit number %d (--yes).\n", defaultIndex)
+			} else {
+				fmt.Fprintf(infoOutput(), "Enter the number of the commit to rollback to [%d]: ", defaultIndex)
+				line, err := readLine()
+				if err != nil {
+					return "", err
+				}
+				input = line
+			}
+			if input == "" {
+				input = strconv.Itoa(defaultIndex)
+			}
+			var err error
+			index, err = strconv.Atoi(input)
+			if err != nil || index < 1 || index > len(history) {
+				fmt.Fprintln(os.Stderr, "Invalid number. Please try again.")
+				continue
+			}
+		}
+
+		// Commit number 1 is the file as it is now. In directory mode that
+		// skips the file; otherwise it is more likely a slip than a choice,
+		// so ask again unless the user means it.
+		if index == 1 && firstIsCurrent {
+			if inDirectory || assumeYes {
+				infof("Skipping '%s': commit number 1 is its current version.\n", filePath)
+				return "", nil
+			}
+			fmt.Fprintf(os.Stderr, "Warning: commit number 1 is the current version of '%s', so choosing it rolls nothing back.\n", filePath)
+			ok, err := confirm("Leave the file as it is?")
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				continue
+			}
+			infof("No rollback has been done for '%s' because it is already at commit number 1.\n", filePath)
+			return "", nil
+		}
+
+		// Echo a typed choice back, since a mistyped number would otherwise
+		// roll back to the wrong version.
+		entry := history[index-1]
+		if !assumeYes && !picking {
+			fmt.Fprintf(infoOutput(), "Selected %s\n", formatEntry(entry))
+			ok, err := confirm("Roll back to this commit?")
+			if err != nil {
+				return "", err
+			}
+			if !ok {
+				continue
+			}
+		}
+
+		return entryHash(entry), nil
+	}
+}
+
+// resolveTargetCommit shows the file's history and picks the commit to roll
+// back to: selected, the one --steps, --commit, --ref or --yes chose, if
+// any, or else from the other flags or interactively. inDirectory is set
+// when the file is one of several being rolled back; with
+// --interactive-each, the user is then asked whether to roll it back at
+// all. It returns "" when the file is to be left as it is.
+func resolveTargetCommit(filePath string, history []rollback.CommitEntry, selected string, inDirectory bool) (string, error) {
+	// --before and --grep report an empty history in their own terms.
+	if len(history) == 0 && opts.Since != "" && opts.Before == "" && opts.Grep == "" {
+		return "", fmt.Errorf("no commits to '%s' since %s", filePath, opts.Since)
+	}
+	if len(history) == 0 && opts.Before == "" && opts.Grep == "" {
+		return "", fmt.Errorf("no history found for '%s'", filePath)
+	}
+	commit, flagErr := selected, error(nil)
+	if commit == "" {
+		commit, flagErr = selectCommitFromFlags(filePath, history)
+	}
+	// The picker lists the history itself.
+	picking := flagErr == nil && commit == "" && usePicker()
+	if !picking {
+		listHistory(filePath, history)
+	}
+
+	if inDirectory && interactiveEach && !assumeYes {
+		fmt.Fprintf(infoOutput(), "Roll back '%s'? ([r]oll back/[s]kip/[a]bort) [r]: ", filePath)
+		line, err := readLine()
+		if err != nil {
+			return "", err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "", "r", "roll back":
+		case "s", "skip":
+			return "", nil
+		case "a", "abort":
+			return "", errAborted
+		default:
+			fmt.Fprintf(os.Stderr, "Unrecognized answer '%s'; skipping '%s'.\n", line, filePath)
+			return "", nil
+		}
+	}
+
+	if flagErr != nil {
+		return "", flagErr
+	}
+	if commit == "" {
+		return promptForCommit(filePath, history, opts.Grep == "", picking, inDirectory)
+	}
+
+	return commit, nil
+}
+
+func handleSingleRolloutFile(filePath string) error {
+	plan, err := buildPlan([]string{filePath}, false)
 	if err != nil {
-		return false, "", fmt.Errorf("not a git repository")
+		return err
+	}
+	if len(plan.Rollbacks) == 0 {
+		return printSingleReport(filePath)
+	}
+
+	if showDiffs {
+		commit := plan.Rollbacks[0].Commit
+		if err := rollback.ShowDiff(filePath, commit, opts); err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			commit = shownCommit(filePath, commit)
+			ok, err := confirm(fmt.Sprintf("Roll back '%s' to commit %s?", filePath, commit))
+			if err != nil {
+				return err
+			}
+			if !ok {
+				infof("Skipped rollback of '%s'.\n", filePath)
+				recordOutcome(fileOutcome{File: filePath, Status: statusSkipped, Commit: commit, Reason: "declined after the diff"})
+				return printSingleReport(filePath)
+			}
+		}
+	}
+
+	err = executePlan(plan)
+	if reportErr := printSingleReport(filePath); reportErr != nil && err == nil {
+		err = reportErr
+	}
+
+	return err
+}
+
+// printSingleReport prints the report for a single file with --output json
+// or yaml, whose output is that document, with the file's history; the text
+// output already listed it and said how the rollback went.
+func printSingleReport(filePath string) error {
+	if outputFormat == "text" {
+		return nil
+	}
+	reportHistory = histories[filePath]
+	if reportHistory == nil {
+		reportHistory = []rollback.CommitEntry{}
+	}
+	return printReport()
+}
+
+// handleProtectedBranch lets a rollback start on a protected branch when it
+// will be committed on a new branch, from --branch or --auto-branch, and
+// otherwise suggests how to get off the protected branch.
+func handleProtectedBranch(err error) error {
+	var protected *rollback.ProtectedBranchError
+	if !errors.As(err, &protected) {
+		return err
+	}
+	if rollbackBranch != "" {
+		return nil
+	}
+	branch := "rollback/" + time.Now().Format(timestampFormat)
+	if autoBranch {
+		rollbackBranch = branch
+		return nil
 	}
 
-	isRepo := strings.TrimSpace(string(out)) == "true"
-	if !isRepo {
-		return false, "", fmt.Errorf("not a git repository")
+	return fmt.Errorf("%v; create a branch first (git switch -c %s), or pass --branch <name> or --auto-branch to have one created", err, branch)
+}
+
+// switchToRollbackBranch creates and checks out the --branch branch, if one
+// was requested, so rollbacks are committed there instead.
+func switchToRollbackBranch() error {
+	if rollbackBranch == "" || branchCreated {
+		return nil
 	}
+	if err := rollback.CreateBranch(rollbackBranch, opts); err != nil {
+		return err
+	}
+	if !opts.DryRun {
+		infof("Switched to new branch '%s'.\n", rollbackBranch)
+	}
+	currentBranch = rollbackBranch
+	branchCreated = true
 
-	cmd = exec.Command("git", "branch", "--show-current")
-	branchOut, err := cmd.Output()
+	return nil
+}
+
+// displayHash abbreviates a full commit hash the rollback package returned,
+// unless --full-hash is set.
+func displayHash(hash string) string {
+	if hash == "" || fullHash {
+		return hash
+	}
+	entry, err := rollback.ResolveRef(hash, opts)
 	if err != nil {
-		return false, "", fmt.Errorf("failed to get the current branch")
+		return hash
 	}
 
-	currentBranch := strings.TrimSpace(string(branchOut))
-	protectedBranches := []string{"master", "develop", "main"}
-	for _, branch := range protectedBranches {
-		if currentBranch == branch {
-			return true, currentBranch, fmt.Errorf("current branch '%s' is a protected branch", currentBranch)
+	return entry.Hash
+}
+
+// shownCommit is how a commit in a plan, a full hash, is shown for the file:
+// as in its history, abbreviated unless --full-hash is set.
+func shownCommit(filePath string, commit string) string {
+	if fullHash {
+		return commit
+	}
+	for _, entry := range histories[filePath] {
+		if entry.FullHash == commit {
+			return entry.Hash
 		}
 	}
 
-	return true, currentBranch, nil
+	return displayHash(commit)
 }
 
-func getFileGitHistory(filePath string) ([]string, error) {
-	cmd := exec.Command("git", "log", "--pretty=format:%h, %an, %ad, %s", "--date=format:%Y-%m-%d %H:%M:%S", "-n", "10", "--", filePath)
-	output, err := cmd.Output()
+// buildPlan plans the rollback of the files, each rolled back to the commit
+// --steps, --commit, --ref or --default-step with --yes selects, or else to
+// the one resolveTargetCommit picks. inDirectory is set when the files are
+// several being rolled back, where a file that can't be rolled back as the
+// flags ask is skipped rather than failing the run.
+func buildPlan(files []string, inDirectory bool) (*rollback.Plan, error) {
+	planOpts := opts
+	planOpts.Steps = rollbackSteps
+	planOpts.Commit = targetCommit
+	planOpts.Ref = targetRef
+	planOpts.DeleteMissing = deleteMissing
+	if assumeYes && targetCommit == "" && targetRef == "" && rollbackSteps == 0 && opts.Before == "" && opts.Grep == "" && authorFilter == "" && !toLastTag {
+		planOpts.Steps = defaultStep
+	}
+
+	// decided are the files whose outcome was recorded as they were planned.
+	decided := map[string]bool{}
+	histories = map[string][]rollback.CommitEntry{}
+	planOpts.Choose = func(file string, history []rollback.CommitEntry, selected string) (string, error) {
+		histories[file] = history
+		commit, err := resolveTargetCommit(file, history, selected, inDirectory)
+		if err != nil && inDirectory && keepGoing && !errors.Is(err, errAborted) && !errors.Is(err, errNoInput) && !errors.Is(err, errNoTTY) {
+			fmt.Fprintln(os.Stderr, errorColor.Sprint("Error:"), err)
+			recordOutcome(fileOutcome{File: file, Status: statusFailed, Reason: err.Error()})
+			decided[file] = true
+			return "", nil
+		}
+		if err == nil && commit == "" {
+			recordOutcome(fileOutcome{File: file, Status: statusSkipped, Reason: "left as it is"})
+			decided[file] = true
+		}
+		return commit, err
+	}
+	plan, err := rollback.BuildPlan(files, planOpts)
 	if err != nil {
-		return nil, fmt.Errorf("failed to retrieve git history: %v", err)
+		return nil, err
+	}
+	histories = plan.Histories
+
+	for _, skipped := range plan.Skipped {
+		if decided[skipped.File] {
+			continue
+		}
+		if !inDirectory && (rollbackSteps > 0 || targetCommit != "") {
+			if strings.HasPrefix(skipped.Reason, "did not exist") {
+				return nil, usageErrorf("'%s' %s, so it cannot be rolled back to it", skipped.File, skipped.Reason)
+			}
+			return nil, usageErrorf("%s", skipped.Reason)
+		}
+		infof("Skipping '%s': %s.\n", skipped.File, skipped.Reason)
+		recordOutcome(fileOutcome{File: skipped.File, Status: statusSkipped, Reason: skipped.Reason})
 	}
+	if opts.DryRun {
+		dryRunPlan = plan
+	}
+
+	return plan, nil
+}
 
-	history := strings.Split(strings.TrimSpace(string(output)), "\n")
-	fmt.Printf("\nGit history for '%s':\n", filePath)
-	for i, line := range history {
-		if i+1 < 10 {
-			fmt.Printf(" %d. %s\n", i+1, line)
+// executePlan switches to the --branch branch and rolls back the files in
+// the plan, or in a dry run describes doing so. A dry run leaves the files
+// already at their commit out of the plan --plan-out saves.
+func executePlan(plan *rollback.Plan) error {
+	if err := switchToRollbackBranch(); err != nil {
+		return err
+	}
+	result, err := rollback.Execute(executionPlan(plan))
+	if result == nil || !opts.DryRun {
+		return err
+	}
+
+	unchanged := map[string]bool{}
+	for _, r := range result.Unchanged {
+		unchanged[r.File] = true
+	}
+	rollbacks := plan.Rollbacks[:0:0]
+	for _, r := range plan.Rollbacks {
+		if unchanged[r.File] {
+			plan.Skipped = append(plan.Skipped, rollback.SkippedFile{File: r.File, Reason: "already matches commit " + r.Commit})
 		} else {
-			fmt.Printf("%d. %s\n", i+1, line)
+			rollbacks = append(rollbacks, r)
 		}
 	}
+	plan.Rollbacks = rollbacks
 
-	return history, nil
+	return err
 }
 
-func rollbackToCommit(filePath string, commit string) error {
-	cmd := exec.Command("git", "checkout", commit, "--", filePath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to checkout commit: %v", err)
+// executionPlan returns a copy of the plan to execute with the batching,
+// --jobs and --keep-going flags, recording each outcome as it happens. The
+// commits are named as they are shown, since messages and commit messages
+// name them.
+func executionPlan(plan *rollback.Plan) *rollback.Plan {
+	progress := newProgress(len(plan.Rollbacks))
+	batched := (singleCommit || commitPerDir) && !opts.DryRun
+	execOpts := opts
+	execOpts.SingleCommit = singleCommit
+	execOpts.CommitPerDir = commitPerDir
+	execOpts.Jobs = jobs
+	// Concurrent rollbacks carry on past failures, which are reported as
+	// they happen and recorded for the summary.
+	execOpts.KeepGoing = keepGoing || (jobs > 1 && !batched)
+	// A nil Stdout is --quiet, where the rollback package prints nothing.
+	stdout := opts.Stdout
+	if stdout == nil {
+		stdout = io.Discard
+	}
+	execOpts.Stdout = progress.writer(stdout)
+	execOpts.OnCommit = func(rollbacks []rollback.FileRollback, commit string, err error) {
+		progress.clear()
+		if batched {
+			recordBatch(rollbacks, commit, err, execOpts.KeepGoing)
+		} else {
+			recordRollback(rollbacks[0], commit, err, execOpts.KeepGoing)
+		}
+		progress.advance(len(rollbacks))
 	}
 
-	commitMessage := fmt.Sprintf("Successfully rolled back '%s' to commit %s", filePath, commit)
-	cmd = exec.Command("git", "commit", "-m", commitMessage, filePath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to create commit: %v", err)
+	shown := plan.WithOptions(execOpts)
+	hashes := map[string]string{}
+	for i, r := range shown.Rollbacks {
+		if _, ok := hashes[r.Commit]; !ok {
+			hashes[r.Commit] = shownCommit(r.File, r.Commit)
+		}
+		shown.Rollbacks[i].Commit = hashes[r.Commit]
 	}
 
-	return nil
+	return shown
 }
 
-func countRolloutFiles(dirPath string) ([]string, error) {
-	var files []string
-	err := filepath.Walk(dirPath, func(path string, info os.FileInfo, err error) error {
+// recordRollback records the outcome of rolling back one file, or of
+// describing it in a dry run, given the commit that recorded it or the error
+// it failed with, which is reported here when the run keeps going.
+func recordRollback(r rollback.FileRollback, commit string, err error, keepsGoing bool) {
+	switch {
+	case errors.Is(err, rollback.ErrUnchanged) && opts.Patch:
+		infof("No changes to '%s' were chosen; no commit created.\n", r.File)
+		recordOutcome(fileOutcome{File: r.File, Status: statusSkipped, Commit: r.Commit, Reason: "no changes chosen"})
+	case errors.Is(err, rollback.ErrUnchanged):
+		infof("'%s' already matches commit %s, nothing changed; no commit created.\n", r.File, r.Commit)
+		recordOutcome(fileOutcome{File: r.File, Status: statusSkipped, Commit: r.Commit, Reason: "already matches commit " + r.Commit})
+	case err != nil:
+		recordOutcome(fileOutcome{File: r.File, Status: statusFailed, Commit: r.Commit, Reason: err.Error()})
+		if keepsGoing {
+			fmt.Fprintln(os.Stderr, errorColor.Sprint("Error:"), fmt.Errorf("failed to roll back '%s': %v", r.File, err))
+		}
+	case r.Delete:
+		recordOutcome(fileOutcome{File: r.File, Status: statusWouldRollBack, Commit: r.Commit, Reason: "delete, as it did not exist at " + r.Commit, deleted: true})
+	case opts.DryRun:
+		insertions, deletions, err := rollback.DiffStat(r.File, r.Commit, opts)
 		if err != nil {
-			return err
+			fmt.Fprintln(os.Stderr, errorColor.Sprint("Error:"), err)
 		}
-		if !info.IsDir() && strings.EqualFold(info.Name(), "rollout.yaml") {
-			files = append(files, path)
+		infof("[dry-run]   %d insertions(+), %d deletions(-)\n", insertions, deletions)
+		dryRunStat.Lock()
+		dryRunStat.insertions += insertions
+		dryRunStat.deletions += deletions
+		dryRunStat.Unlock()
+		recordOutcome(fileOutcome{File: r.File, Status: statusWouldRollBack, Commit: r.Commit})
+	default:
+		commit = displayHash(commit)
+		recordOutcome(fileOutcome{File: r.File, Status: statusRolledBack, Commit: r.Commit, NewCommit: commit})
+		if commit != "" {
+			successf("Successfully rolled back '%s' to commit %s in commit %s.", r.File, r.Commit, commit)
 		}
-		return nil
-	})
+	}
+}
+
+// recordBatch records the outcome of rolling back files in a single commit,
+// with --single-commit or --commit-per-dir, given the commit or the error
+// they failed with, which is reported here when the run keeps going. Files
+// already at their commit come with ErrUnchanged and the commit they were
+// left out of, if one was made.
+func recordBatch(rollbacks []rollback.FileRollback, commit string, err error, keepsGoing bool) {
+	where, files := "", "files"
+	if commitPerDir {
+		where = fmt.Sprintf(" in '%s'", filepath.Dir(rollbacks[0].File))
+	}
+	if len(rollbacks) == 1 {
+		files = "file"
+	}
+	if errors.Is(err, rollback.ErrUnchanged) && commit != "" {
+		verb := "are"
+		if len(rollbacks) == 1 {
+			verb = "is"
+		}
+		infof("%d %s%s %s already at that version, so left out of commit %s.\n", len(rollbacks), files, where, verb, displayHash(commit))
+	} else if errors.Is(err, rollback.ErrUnchanged) {
+		infof("All %d %s%s are already at that version, no commit created.\n", len(rollbacks), files, where)
+	}
+	if errors.Is(err, rollback.ErrUnchanged) {
+		for _, r := range rollbacks {
+			recordOutcome(fileOutcome{File: r.File, Status: statusSkipped, Commit: r.Commit, Reason: "already matches commit " + r.Commit})
+		}
+		return
+	}
+	if err != nil {
+		for _, r := range rollbacks {
+			recordOutcome(fileOutcome{File: r.File, Status: statusFailed, Commit: r.Commit, Reason: err.Error()})
+		}
+		if keepsGoing {
+			fmt.Fprintln(os.Stderr, errorColor.Sprint("Error:"), fmt.Errorf("failed to roll back%s: %v", where, err))
+		}
+		return
+	}
+	commit = displayHash(commit)
+	for _, r := range rollbacks {
+		outcome := fileOutcome{File: r.File, Status: statusRolledBack, Commit: r.Commit, NewCommit: commit}
+		if r.Delete {
+			outcome.Reason = "deleted, as it did not exist at " + r.Commit
+			outcome.deleted = true
+		}
+		recordOutcome(outcome)
+	}
+	if commit != "" && commitPerDir {
+		successf("Successfully rolled back %d %s%s in commit %s.", len(rollbacks), files, where, commit)
+	} else if commit != "" {
+		successf("Successfully rolled back %d files in a single commit %s.", len(rollbacks), commit)
+	}
+}
+
+func confirm(prompt string) (bool, error) {
+	if assumeYes {
+		return true, nil
+	}
+	fmt.Fprintf(infoOutput(), "%s (y/N): ", prompt)
+	line, err := readLine()
+	if err != nil {
+		return false, err
+	}
+	response := strings.ToLower(strings.TrimSpace(line))
+	return response == "y" || response == "yes", nil
+}
 
+// findTrackedRolloutFiles discovers the rollout files under dirPath,
+// leaving out any git doesn't track since they have nothing to roll back to.
+func findTrackedRolloutFiles(dirPath string) ([]string, error) {
+	files, err := rollback.FindRolloutFiles(dirPath, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to walk the directory: %v", err)
+	}
+	files, untracked, err := rollback.FilterTracked(dirPath, files, opts)
 	if err != nil {
 		return nil, err
 	}
+	if len(untracked) > 0 {
+		infof("Skipping %d untracked or ignored rollout files.\n", len(untracked))
+	}
+	logger.Info("discovered rollout files", "dir", dirPath, "found", len(files), "untracked", len(untracked))
+	for _, file := range untracked {
+		logger.Debug("skipped untracked rollout file", "file", file)
+	}
 
 	return files, nil
 }
 
-func handleSingleRolloutFile(filePath string) {
-	history, err := getFileGitHistory(filePath)
+// handleDirectoryRolloutFiles rolls back the rollout files under dirPath or,
+// with --changed-between, those under it that changed in that range.
+func handleDirectoryRolloutFiles(dirPath string) error {
+	var files []string
+	var err error
+	if changedBetween != "" {
+		files, err = rollback.ChangedFiles(baseCommit, changedTo, dirPath, opts)
+		if err == nil && len(files) == 0 {
+			infof("No rollout files under '%s' changed in %s.\n", dirPath, changedBetween)
+			return nil
+		}
+	} else {
+		files, err = findTrackedRolloutFiles(dirPath)
+	}
 	if err != nil {
-		fmt.Println("Error:", err)
-		os.Exit(1)
+		return err
+	}
+	if maxFiles > 0 && len(files) > maxFiles && !opts.DryRun {
+		return usageErrorf("found %d rollout files under '%s', more than --max-files %d; narrow the path, or raise --max-files if you mean to roll back all of them", len(files), dirPath, maxFiles)
 	}
 
-	for {
-		defaultIndex := 2
-		if len(history) < defaultIndex {
-			defaultIndex = len(history)
+	if outputFormat != "text" {
+		recordDiscovered(files)
+	} else {
+		infof("Found %d rollout files:\n", len(files))
+		for _, file := range files {
+			infof("%s\n", file)
 		}
-		fmt.Printf("Enter the number of the commit to rollback to [%d]: ", defaultIndex)
-		scanner := bufio.NewScanner(os.Stdin)
-		scanner.Scan()
-		input := scanner.Text()
-		if input == "" {
-			input = strconv.Itoa(defaultIndex)
+	}
+
+	return handleRolloutFiles(files)
+}
+
+// recordDiscovered adds the discovered files to the report --output json or
+// yaml prints, each with its latest commit once buildPlan has read it.
+func recordDiscovered(files []string) {
+	discovered = []discoveredFile{}
+	for _, file := range files {
+		discovered = append(discovered, discoveredFile{File: file})
+	}
+}
+
+// handleFileList rolls back the files listed, one per line, in listPath, or
+// on stdin if listPath is "-". Every file must exist and be tracked by git.
+func handleFileList(listPath string) error {
+	var scanner *bufio.Scanner
+	if listPath == "-" {
+		scanner = stdin
+	} else {
+		f, err := os.Open(listPath)
+		if err != nil {
+			return usageErrorf("failed to open file list: %v", err)
 		}
-		index, err := strconv.Atoi(input)
-		if err != nil || index < 1 || index > len(history) {
-			fmt.Println("Invalid number. Please try again.")
+		defer f.Close()
+		scanner = bufio.NewScanner(f)
+	}
+
+	var files []string
+	for scanner.Scan() {
+		file := strings.TrimSpace(scanner.Text())
+		if file == "" {
 			continue
 		}
+		file = normalizePath(file)
+		if err := checkExists(file); err != nil {
+			return err
+		}
+		if err := checkTracked(file); err != nil {
+			return err
+		}
+		files = append(files, file)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read file list: %v", err)
+	}
+
+	infof("Read %d rollout files:\n", len(files))
+	for _, file := range files {
+		infof("%s\n", file)
+	}
 
-		if index == 1 {
-			fmt.Printf("No rollback has been done for '%s' because it is already at commit number 1.\n", filePath)
-			break
+	return handleRolloutFiles(files)
+}
+
+// normalizePath cleans a path given on the command line, so "./svc/",
+// "svc" and an absolute path to it all name the file or directory the same
+// way, relative to the working directory that every git command runs in.
+func normalizePath(p string) string {
+	if filepath.IsAbs(p) {
+		base, err := filepath.Abs(opts.Dir)
+		if err == nil {
+			if rel, err := filepath.Rel(base, p); err == nil {
+				p = rel
+			}
 		}
+	}
 
-		commit := strings.Split(history[index-1], ",")[0]
-		if err := rollbackToCommit(filePath, commit); err != nil {
-			fmt.Println("Error rolling back:", err)
-			os.Exit(1)
+	return filepath.Clean(p)
+}
+
+// checkExists refuses a path that doesn't exist, unless --restore-deleted
+// lets a deleted rollout file be recreated from its history.
+func checkExists(filePath string) error {
+	if _, err := os.Stat(filepath.Join(opts.Dir, filePath)); !os.IsNotExist(err) {
+		return nil
+	}
+	if !rollback.IsRolloutPath(filePath, opts) {
+		return usageErrorf("the path '%s' does not exist", filePath)
+	}
+	if !restoreDeleted {
+		return usageErrorf("the path '%s' does not exist; pass --restore-deleted to recreate it from its history", filePath)
+	}
+
+	return nil
+}
+
+// checkTracked fails with a usage error if git doesn't track the file, since
+// it then has no history to roll back to.
+func checkTracked(filePath string) error {
+	tracked, err := rollback.IsTracked(filePath, opts)
+	if err != nil {
+		return err
+	}
+	// A deleted file is no longer tracked, but its history remains.
+	if !tracked && restoreDeleted {
+		if _, err := os.Stat(filepath.Join(opts.Dir, filePath)); os.IsNotExist(err) {
+			return nil
 		}
-		fmt.Printf("Successfully rolled back '%s' to commit %s.\n", filePath, commit)
-		break
 	}
+	if !tracked {
+		return usageErrorf("'%s' is not tracked by git, so it has no history to roll back to; commit it first", filePath)
+	}
+
+	return nil
 }
 
-func handleDirectoryRolloutFiles(dirPath string) {
-	files, err := countRolloutFiles(dirPath)
+// handleRolloutFiles confirms, resolves and applies the rollback of several
+// files.
+func handleRolloutFiles(files []string) error {
+	if opts.DryRun {
+		infof("Dry run: previewing rollback for all %d rollout files...\n", len(files))
+	} else if assumeYes || assumeContinue || interactiveEach {
+		infof("Proceeding with rollback for all %d rollout files...\n", len(files))
+	} else {
+		fmt.Fprintf(infoOutput(), "Would you like to continue with rolling back all %d of these files? (yes/no): ", len(files))
+		line, err := readLine()
+		if err != nil {
+			return err
+		}
+		response := strings.ToLower(line)
+		if response != "yes" {
+			return errAborted
+		}
+
+		infof("Proceeding with rollback for all %d rollout files...\n", len(files))
+	}
+	plan, err := buildPlan(files, true)
 	if err != nil {
-		fmt.Println("Error walking the directory:", err)
-		os.Exit(1)
+		return err
+	}
+	for i, entry := range discovered {
+		if history := histories[entry.File]; len(history) > 0 {
+			discovered[i].LatestCommit = entryHash(history[0])
+		}
 	}
 
-	fmt.Printf("Found %d rollout.yaml files:\n", len(files))
-	for _, file := range files {
-		fmt.Println(file)
+	if len(plan.Rollbacks) > 0 && showDiffs {
+		err = showDiffsAndConfirm(plan)
 	}
+	if err == nil && len(plan.Rollbacks) > 0 {
+		err = executePlan(plan)
+	}
+	if errors.Is(err, errAborted) {
+		return err
+	}
+	if reportErr := printReport(); reportErr != nil && err == nil {
+		err = reportErr
+	}
+	if opts.DryRun && outputFormat == "text" {
+		infof("[dry-run] In total: %d insertions(+), %d deletions(-)\n", dryRunStat.insertions, dryRunStat.deletions)
+	}
+	if failed := countOutcomes(statusFailed); err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d files failed to roll back", failed, len(files))
+	}
+
+	return err
+}
 
-	fmt.Printf("Would you like to continue with rolling back all %d of these files? (yes/no): ", len(files))
-	scanner := bufio.NewScanner(os.Stdin)
-	scanner.Scan()
-	response := strings.ToLower(scanner.Text())
-	if response != "yes" {
-		fmt.Println("Operation aborted by the user.")
-		os.Exit(0)
+// showDiffsAndConfirm shows the diff each rollback in the plan would apply
+// and, unless it is a dry run, asks whether to go ahead.
+func showDiffsAndConfirm(plan *rollback.Plan) error {
+	for _, r := range plan.Rollbacks {
+		if err := rollback.ShowDiff(r.File, r.Commit, opts); err != nil {
+			return err
+		}
+	}
+	if opts.DryRun {
+		return nil
+	}
+	ok, err := confirm(fmt.Sprintf("Roll back these %d files?", len(plan.Rollbacks)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errAborted
 	}
 
-	fmt.Println("Proceeding with rollback for all %d rollout.yaml files...", len(files))
+	return nil
+}
+
+// publishRollback tags, pushes and opens a pull request for the rollbacks,
+// as requested by --tag, --push and --open-pr.
+func publishRollback() error {
+	if len(rolledBack) == 0 {
+		return nil
+	}
+	if tagName != "" {
+		if err := rollback.TagRollback(tagName, rolledBack, forceTag, opts); err != nil {
+			return err
+		}
+		if !opts.DryRun {
+			successf("Tagged the rollback as '%s'.", tagName)
+		}
+	}
+	if !pushRollback {
+		return nil
+	}
+
+	if err := rollback.Push(currentBranch, remoteName, branchCreated, opts); err != nil {
+		return err
+	}
+	if !opts.DryRun {
+		successf("Pushed '%s' to %s.", currentBranch, remoteName)
+	}
+	if !openPR {
+		return nil
+	}
+	url, err := rollback.OpenPullRequest(currentBranch, remoteName, rolledBack, opts)
+	if err != nil {
+		return err
+	}
+	if url != "" {
+		fmt.Fprintln(infoOutput(), url)
+	}
+
+	return nil
+}
+
+// handleList prints the history of a rollout file, or of every rollout file
+// in a directory.
+func handleList(inputPath string) error {
+	if rollback.IsRolloutPath(inputPath, opts) {
+		if err := checkTracked(inputPath); err != nil {
+			return err
+		}
+		history, err := rollback.FileHistory(inputPath, opts)
+		if err != nil {
+			return err
+		}
+		return printHistory(inputPath, history)
+	}
+
+	files, err := findTrackedRolloutFiles(inputPath)
+	if err != nil {
+		return err
+	}
+	histories, err := rollback.FileHistories(files, repo, opts)
+	if err != nil {
+		return err
+	}
+	if outputFormat != "text" {
+		type fileHistory struct {
+			File    string                 `json:"file" yaml:"file"`
+			History []rollback.CommitEntry `json:"history" yaml:"history"`
+		}
+		list := []fileHistory{}
+		for _, file := range files {
+			list = append(list, fileHistory{File: file, History: histories[file]})
+		}
+		return printStructured(list)
+	}
 	for _, file := range files {
-		handleSingleRolloutFile(file)
+		if err := printHistory(file, histories[file]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func handleUndo() error {
+	hash, message, err := rollback.LatestCommit(opts)
+	if err != nil {
+		return err
+	}
+
+	subject, _, _ := strings.Cut(strings.TrimSpace(message), "\n")
+	if !rollback.IsRollbackCommitMessage(message, opts) {
+		return fmt.Errorf("the latest commit %s (%s) was not created by rollback; nothing to undo", hash, subject)
+	}
+
+	infof("Latest rollback commit: %s %s\n", hash, subject)
+	if opts.DryRun {
+		infof("[dry-run] Would revert commit %s\n", hash)
+		return nil
+	}
+	ok, err := confirm(fmt.Sprintf("Revert commit %s?", hash))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errAborted
 	}
+
+	if err := rollback.RevertCommit(hash, opts); err != nil {
+		return err
+	}
+	successf("Successfully undid rollback commit %s.", hash)
+	return nil
+}
+
+// completeRolloutPaths completes the path argument with directories and
+// rollout files.
+func completeRolloutPaths(cmd *cobra.Command, args []string, toComplete string) ([]string, cobra.ShellCompDirective) {
+	if len(args) > 0 {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	dir, prefix := filepath.Split(toComplete)
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+	entries, err := os.ReadDir(readDir)
+	if err != nil {
+		return nil, cobra.ShellCompDirectiveNoFileComp
+	}
+
+	var candidates []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || (strings.HasPrefix(name, ".") && !strings.HasPrefix(prefix, ".")) {
+			continue
+		}
+		if entry.IsDir() {
+			candidates = append(candidates, dir+name+"/")
+		} else if rollback.IsRolloutPath(name, opts) {
+			candidates = append(candidates, dir+name)
+		}
+	}
+
+	return candidates, cobra.ShellCompDirectiveNoSpace | cobra.ShellCompDirectiveNoFileComp
+}
+
+func validateFlags() error {
+	if opts.Limit < 1 {
+		return usageErrorf("invalid --limit %d: must be a positive integer", opts.Limit)
+	}
+	if outputFormat != "text" && outputFormat != "json" && outputFormat != "yaml" {
+		return usageErrorf("invalid --output '%s': must be 'text', 'json' or 'yaml'", outputFormat)
+	}
+	if changedBetween != "" {
+		if baseCommit != "" {
+			return usageErrorf("--changed-between cannot be used with --base-commit")
+		}
+		if fromFile != "" {
+			return usageErrorf("--changed-between cannot be used with --from-file")
+		}
+		from, to, ok := strings.Cut(changedBetween, "..")
+		if !ok || from == "" || to == "" || strings.HasPrefix(to, ".") {
+			return usageErrorf("invalid --changed-between '%s': must be <ref1>..<ref2>", changedBetween)
+		}
+		// The files are restored as with --base-commit ref1.
+		baseCommit, changedTo = from, to
+	}
+	if commitPerDir && singleCommit {
+		return usageErrorf("--commit-per-dir cannot be used with --single-commit")
+	}
+	if baseCommit != "" {
+		if opts.Strategy == "revert" {
+			return usageErrorf("--base-commit cannot be used with --strategy revert")
+		}
+		if targetRef != "" {
+			return usageErrorf("--base-commit cannot be used with --ref")
+		}
+		targetRef = baseCommit
+		// Deletions need a batch commit; --commit-per-dir makes them too.
+		singleCommit = !commitPerDir
+	} else if deleteMissing {
+		return usageErrorf("--delete-missing (--prune) requires --base-commit")
+	}
+	if singleCommit && opts.Strategy == "revert" {
+		return usageErrorf("--single-commit cannot be used with --strategy revert")
+	}
+	if commitPerDir && opts.Strategy == "revert" {
+		return usageErrorf("--commit-per-dir cannot be used with --strategy revert")
+	}
+	opts.Trailers = nil
+	for _, trailer := range trailers {
+		key, value, ok := strings.Cut(trailer, "=")
+		if !ok || strings.TrimSpace(key) == "" || strings.TrimSpace(value) == "" {
+			return usageErrorf("invalid --trailer '%s': must be key=value", trailer)
+		}
+		opts.Trailers = append(opts.Trailers, strings.TrimSpace(key)+": "+strings.TrimSpace(value))
+	}
+	if onComplete != "" {
+		if _, err := template.New("on-complete").Parse(onComplete); err != nil {
+			return usageErrorf("invalid --on-complete: %v", err)
+		}
+	} else if onCompleteAlways {
+		return usageErrorf("--on-complete-always requires --on-complete")
+	}
+	if notifyWebhook != "" {
+		if u, err := url.Parse(notifyWebhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return usageErrorf("invalid --notify-webhook '%s': must be an http or https URL", notifyWebhook)
+		}
+	}
+	if notifyOn != "success" && notifyOn != "failure" && notifyOn != "always" {
+		return usageErrorf("invalid --notify-on '%s': must be 'success', 'failure' or 'always'", notifyOn)
+	}
+	opts.NoMerges = !includeMerges
+	if opts.Patch && !stdinIsTerminal {
+		return usageErrorf("--patch needs a terminal to choose the changes on")
+	}
+	if opts.Patch && jobs > 1 {
+		return usageErrorf("--patch cannot be used with --jobs")
+	}
+	if opts.ForceUnlock && opts.WaitLock == 0 {
+		return usageErrorf("--force-unlock requires --wait-lock, which sets how old a stale lock must be")
+	}
+	if planOut != "" && !opts.DryRun {
+		return usageErrorf("--plan-out requires --dry-run")
+	}
+	if maxFiles < 0 {
+		return usageErrorf("invalid --max-files %d: must not be negative", maxFiles)
+	}
+	if jobs < 1 {
+		return usageErrorf("invalid --jobs %d: must be a positive integer", jobs)
+	}
+	if openPR {
+		if err := rollback.CheckGitHubCLI(opts); err != nil {
+			return err
+		}
+		pushRollback = true
+	}
+	if pushRollback && opts.NoCommit {
+		return usageErrorf("--push and --open-pr cannot be used with --no-commit")
+	}
+	if rollbackBranch == "auto" {
+		rollbackBranch = "rollback/" + time.Now().Format(timestampFormat)
+	}
+	if tagName != "" {
+		if opts.NoCommit {
+			return usageErrorf("--tag cannot be used with --no-commit")
+		}
+		tmpl, err := template.New("tag").Parse(tagName)
+		if err != nil {
+			return usageErrorf("invalid --tag template: %v", err)
+		}
+		var name strings.Builder
+		if err := tmpl.Execute(&name, struct{ Timestamp string }{time.Now().Format(timestampFormat)}); err != nil {
+			return usageErrorf("invalid --tag template: %v", err)
+		}
+		tagName = name.String()
+	}
+	if rollbackSteps < 0 {
+		return usageErrorf("invalid --steps %d: must not be negative", rollbackSteps)
+	}
+	if defaultStep < 1 {
+		return usageErrorf("invalid --default-step %d: must be at least 1", defaultStep)
+	}
+	selectors := 0
+	for _, set := range []bool{targetCommit != "", targetRef != "", rollbackSteps > 0, opts.Before != "", opts.Grep != "", authorFilter != "", toLastTag} {
+		if set {
+			selectors++
+		}
+	}
+	if selectors > 1 {
+		return usageErrorf("only one of --commit, --ref, --steps, --before, --grep, --author-filter and --to-last-tag can be used")
+	}
+	if authorFilter != "" {
+		pattern, negated := strings.CutPrefix(authorFilter, "!")
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return usageErrorf("invalid --author-filter: %v", err)
+		}
+		authorPattern, excludeAuthor = re, negated
+	}
+	if opts.GPGKey != "" {
+		opts.Sign = true
+	}
+	if err := applyColorMode(); err != nil {
+		return err
+	}
+	if err := setupLogger(); err != nil {
+		return err
+	}
+	if verbose {
+		opts.Log = os.Stderr
+	}
+	if quiet {
+		opts.Stdout = nil
+	} else if outputFormat != "text" {
+		opts.Stdout = os.Stderr
+	}
+	if err := opts.Validate(); err != nil {
+		return usageErrorf("%v", err)
+	}
+
+	return nil
 }
 
 func main() {
 	var rootCmd = &cobra.Command{
-		Use:   "rollback [path]",
-		Short: "Check if a file or directory exists at the given path",
-		Args:  cobra.ExactArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
-			inputPath := args[0]
-			if _, err := os.Stat(inputPath); os.IsNotExist(err) {
-				fmt.Printf("The path '%s' does not exist.\n", inputPath)
-				os.Exit(1)
+		Use:           "rollback [path]",
+		Short:         "Check if a file or directory exists at the given path",
+		SilenceErrors: true,
+		SilenceUsage:  true,
+		Args:          usageArgs(cobra.MaximumNArgs(1)),
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if err := loadEnv(cmd); err != nil {
+				return err
+			}
+			if err := loadConfig(cmd); err != nil {
+				return err
+			}
+			return validateFlags()
+		},
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if fromFile != "" && len(args) > 0 {
+				return usageErrorf("a path cannot be given with --from-file")
+			}
+			if fromFile == "" && len(args) == 0 && changedBetween == "" {
+				return usageErrorf("requires a path, or --from-file")
+			}
+			inputPath := "."
+			if len(args) > 0 {
+				inputPath = normalizePath(args[0])
+				if err := checkExists(inputPath); err != nil {
+					return err
+				}
 			}
 
 			// check we are in a git repo
-			_, _, err := isGitRepo()
+			var err error
+			repo, err = rollback.CheckRepo(opts)
 			if err != nil {
-				fmt.Println("Error:", err)
-				os.Exit(1)
+				if err = handleProtectedBranch(err); err != nil {
+					return err
+				}
+			}
+			currentBranch = repo.Branch
+			if opts.Since != "" {
+				if err := rollback.CheckDate(opts.Since, opts); err != nil {
+					return usageErrorf("invalid --since: %v", err)
+				}
+			}
+			if targetRef != "" {
+				_, err := rollback.ResolveRef(targetRef, opts)
+				if err != nil && changedBetween != "" {
+					return usageErrorf("invalid --changed-between: %v", err)
+				} else if err != nil && baseCommit != "" {
+					return usageErrorf("invalid --base-commit: %v", err)
+				} else if err != nil {
+					return usageErrorf("invalid --ref: %v", err)
+				}
+			}
+			if tagName != "" {
+				if err := rollback.CheckTag(tagName, forceTag, opts); err != nil {
+					return err
+				}
+			}
+
+			if err := openAuditLog(); err != nil {
+				return err
 			}
 
-			if strings.HasSuffix(inputPath, "rollout.yaml") {
-				handleSingleRolloutFile(inputPath)
+			if fromFile != "" {
+				err = handleFileList(fromFile)
+			} else if changedBetween != "" {
+				err = handleDirectoryRolloutFiles(inputPath)
+			} else if rollback.IsRolloutPath(inputPath, opts) {
+				err = checkTracked(inputPath)
+				if err == nil {
+					err = handleSingleRolloutFile(inputPath)
+				}
 			} else {
-				handleDirectoryRolloutFiles(inputPath)
+				err = handleDirectoryRolloutFiles(inputPath)
+			}
+			if err == nil && planOut != "" {
+				err = writePlan(planOut)
+			}
+			if err == nil {
+				err = publishRollback()
+			}
+			return finishRollback(err)
+		},
+	}
+	rootCmd.SetFlagErrorFunc(func(cmd *cobra.Command, err error) error {
+		return usageErrorf("%v", err)
+	})
+	rootCmd.SetGlobalNormalizationFunc(func(f *pflag.FlagSet, name string) pflag.NormalizedName {
+		if alias, ok := flagAliases[name]; ok {
+			name = alias
+		}
+		return pflag.NormalizedName(name)
+	})
+
+	var undoCmd = &cobra.Command{
+		Use:   "undo",
+		Short: "Revert the most recent rollback commit",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if _, err := rollback.CheckRepo(opts); err != nil {
+				return err
+			}
+
+			return handleUndo()
+		},
+	}
+	rootCmd.AddCommand(undoCmd)
+
+	var applyCmd = &cobra.Command{
+		Use:   "apply --plan-in file",
+		Short: "Roll back the files in a plan saved with --dry-run --plan-out",
+		Args:  usageArgs(cobra.NoArgs),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if planIn == "" {
+				return usageErrorf("requires --plan-in")
+			}
+			var err error
+			repo, err = rollback.CheckRepo(opts)
+			if err != nil {
+				if err = handleProtectedBranch(err); err != nil {
+					return err
+				}
+			}
+			currentBranch = repo.Branch
+			if tagName != "" {
+				if err := rollback.CheckTag(tagName, forceTag, opts); err != nil {
+					return err
+				}
+			}
+
+			if err := openAuditLog(); err != nil {
+				return err
+			}
+
+			err = handleApply(planIn)
+			if err == nil {
+				err = publishRollback()
+			}
+			return finishRollback(err)
+		},
+	}
+	applyCmd.Flags().StringVar(&planIn, "plan-in", "", "Plan file written by --plan-out")
+	applyCmd.Flags().BoolVar(&forcePlan, "force-plan", false, "Apply the plan even if HEAD has moved since it was made")
+	rootCmd.AddCommand(applyCmd)
+
+	var listCmd = &cobra.Command{
+		Use:               "list path",
+		Short:             "Show the history of a rollout file, or of every rollout file in a directory, without rolling back",
+		Args:              usageArgs(cobra.ExactArgs(1)),
+		ValidArgsFunction: completeRolloutPaths,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			listPath := normalizePath(args[0])
+			if _, err := os.Stat(filepath.Join(opts.Dir, listPath)); os.IsNotExist(err) {
+				return usageErrorf("the path '%s' does not exist", listPath)
+			}
+
+			// Listing changes nothing, so it runs on any branch.
+			readOnly := opts
+			readOnly.ProtectedBranches = nil
+			readOnly.NoDefaultProtected = true
+			readOnly.AllowDetached = true
+			var err error
+			repo, err = rollback.CheckRepo(readOnly)
+			if err != nil {
+				return err
+			}
+			if opts.Since != "" {
+				if err := rollback.CheckDate(opts.Since, opts); err != nil {
+					return usageErrorf("invalid --since: %v", err)
+				}
+			}
+
+			return handleList(listPath)
+		},
+	}
+	rootCmd.AddCommand(listCmd)
+
+	rootCmd.ValidArgsFunction = completeRolloutPaths
+	rootCmd.CompletionOptions.DisableDefaultCmd = true
+	var completionCmd = &cobra.Command{
+		Use:   "completion bash|zsh|fish",
+		Short: "Generate a shell completion script",
+		Long: `Generate a shell completion script for rollback.
+
+To load completions in the current shell:
+
+  bash: source <(rollback completion bash)
+  zsh:  source <(rollback completion zsh)
+  fish: rollback completion fish | source`,
+		ValidArgs: []string{"bash", "zsh", "fish"},
+		Args:      usageArgs(cobra.MatchAll(cobra.ExactArgs(1), cobra.OnlyValidArgs)),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			switch args[0] {
+			case "bash":
+				return rootCmd.GenBashCompletionV2(os.Stdout, true)
+			case "zsh":
+				return rootCmd.GenZshCompletion(os.Stdout)
+			default:
+				return rootCmd.GenFishCompletion(os.Stdout, true)
 			}
 		},
 	}
+	rootCmd.AddCommand(completionCmd)
+
+	rootCmd.Version = versionString()
+	rootCmd.SetVersionTemplate("rollback {{.Version}}\n")
+	var versionCmd = &cobra.Command{
+		Use:   "version",
+		Short: "Print the version, git commit and build date",
+		Args:  usageArgs(cobra.NoArgs),
+		Run: func(cmd *cobra.Command, args []string) {
+			fmt.Printf("rollback %s\n", versionString())
+		},
+	}
+	rootCmd.AddCommand(versionCmd)
+
+	opts.Stdout = os.Stdout
+
+	rootCmd.PersistentFlags().StringVar(&configPath, "config", "", "Config file (default: "+configFileName+" in the working directory or a parent); any flag can also be set with a "+envPrefix+"<FLAG> environment variable (e.g. "+envPrefix+"LIMIT), which overrides the config file")
+	rootCmd.PersistentFlags().StringVar(&opts.Dir, "repo", "", "Run in the repository at this path instead of the working directory; the path argument is relative to it")
+	rootCmd.PersistentFlags().StringVar(&fromFile, "from-file", "", "Roll back the files listed one per line in this file ('-' for stdin) instead of a path")
+	rootCmd.PersistentFlags().BoolVarP(&assumeYes, "yes", "y", false, "Skip all prompts; selects the --default-step commit (by default number 2, the version before the latest) for each file")
+	rootCmd.PersistentFlags().StringVar(&targetCommit, "commit", "", "Roll back directly to this commit hash instead of prompting")
+	rootCmd.PersistentFlags().StringVar(&targetRef, "ref", "", "Roll back to the file's state at any git revision, such as a tag (v1.4.0) or origin/main~3, without prompting")
+	rootCmd.PersistentFlags().StringVar(&changedBetween, "changed-between", "", "Restore the rollout files changed in <ref1>..<ref2> (under the path, if given) to their state at ref1, as --base-commit ref1 would")
+	rootCmd.PersistentFlags().StringVar(&baseCommit, "base-commit", "", "Restore every rollout file to its state at this revision in a single commit; files that did not exist then are skipped")
+	rootCmd.PersistentFlags().BoolVar(&restoreDeleted, "restore-deleted", false, "Accept a rollout file that was deleted but is still in git history, and recreate it at the chosen commit")
+	rootCmd.PersistentFlags().BoolVar(&deleteMissing, "delete-missing", false, "With --base-commit, delete rollout files that did not exist at that revision instead of skipping them (alias --prune)")
+	rootCmd.PersistentFlags().IntVar(&defaultStep, "default-step", 1, "How many versions back the commit offered by default is (1 = number 2, the version before the latest); used by the prompt, the picker and --yes")
+	rootCmd.PersistentFlags().BoolVar(&toLastTag, "to-last-tag", false, "Roll each file back to its version at the most recent tag reachable from HEAD that has a different version")
+	rootCmd.PersistentFlags().IntVar(&rollbackSteps, "steps", 0, "Roll back this many versions of the file (1 = the version before the latest)")
+	rootCmd.PersistentFlags().StringVar(&opts.Format, "format", "", "git pretty format for history entries (e.g. '%h %cd%d %s'); commits are still selected by number")
+	rootCmd.PersistentFlags().StringVar(&opts.Since, "since", "", "Only list commits after this date (e.g. 2024-01-15 or '2 weeks ago'); --limit still applies")
+	rootCmd.PersistentFlags().StringVar(&opts.Before, "before", "", "Roll back to the newest commit at or before this date (e.g. 2024-01-15 or '2 weeks ago')")
+	rootCmd.PersistentFlags().StringVar(&opts.Grep, "grep", "", "Only list commits whose message matches this pattern; a single match is selected automatically")
+	rootCmd.PersistentFlags().StringVar(&opts.ExcludeGrep, "exclude-grep", "", "Leave commits whose subject matches this regular expression (e.g. '^style:') out of the history, apart from the current version")
+	rootCmd.PersistentFlags().BoolVar(&includeMerges, "include-merges", true, "List merge commits in history; --include-merges=false leaves them out")
+	rootCmd.PersistentFlags().BoolVar(&opts.FirstParent, "first-parent", false, "Only list mainline commits, following the first parent of merges")
+	rootCmd.PersistentFlags().BoolVar(&fullHash, "full-hash", false, "Show and roll back to full commit hashes instead of abbreviated ones")
+	rootCmd.PersistentFlags().StringVar(&authorFilter, "author-filter", "", "Roll back to the newest commit whose author name matches this regular expression, or doesn't with a leading '!' (e.g. '!release-bot')")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.Filenames, "filename", []string{"rollout.yaml"}, "Rollout file name to match; repeatable (e.g. --filename rollout.yaml --filename rollout.yml)")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.Include, "include", nil, "Only roll back files whose path relative to the directory matches this glob ('**' spans directories); repeatable")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.Exclude, "exclude", nil, "Skip files and directories whose relative path matches this glob; takes precedence over --include; repeatable")
+	rootCmd.PersistentFlags().IntVar(&opts.MaxDepth, "max-depth", 0, "Only find rollout files at most this many levels below the directory (1 = the directory itself); 0 means no limit")
+	rootCmd.PersistentFlags().IntVar(&maxFiles, "max-files", 0, "Refuse to roll back a directory with more than this many rollout files (dry runs are allowed); 0 means no limit")
+	rootCmd.PersistentFlags().BoolVar(&opts.FollowSymlinks, "follow-symlinks", false, "Follow symlinked directories when finding rollout files")
+	rootCmd.PersistentFlags().IntVar(&opts.Limit, "limit", 10, "Number of commits to show from the file's history")
+	rootCmd.PersistentFlags().StringArrayVar(&opts.ProtectedBranches, "protected-branch", nil, "Additional protected branch name or glob (e.g. 'release/*'); repeatable")
+	rootCmd.PersistentFlags().BoolVar(&opts.NoDefaultProtected, "no-default-protected", false, "Do not treat master, develop and main as protected")
+	rootCmd.PersistentFlags().BoolVar(&opts.AllowDetached, "allow-detached", false, "Allow running in a detached HEAD state, where rollback commits belong to no branch")
+	rootCmd.PersistentFlags().StringVar(&opts.Strategy, "strategy", "checkout", "Rollback strategy: checkout (restore the file and commit) or revert (git revert each later commit that touched the file)")
+	rootCmd.PersistentFlags().BoolVar(&opts.Force, "force", false, "Roll back even if the file has uncommitted local changes, discarding them")
+	rootCmd.PersistentFlags().BoolVar(&opts.Stash, "stash", false, "Stash uncommitted changes to the file before rolling back")
+	rootCmd.PersistentFlags().BoolVar(&commitPerDir, "commit-per-dir", false, "In directory mode, roll back the files in each directory (such as a service's) in one commit per directory")
+	rootCmd.PersistentFlags().BoolVar(&singleCommit, "single-commit", false, "In directory mode, roll back all files in one commit; aborts without committing if any file fails")
+	rootCmd.PersistentFlags().BoolVar(&assumeContinue, "assume-continue", false, "In directory mode, skip the prompt to continue with all files but still choose each file's commit")
+	rootCmd.PersistentFlags().BoolVar(&interactiveEach, "interactive-each", false, "In directory mode, ask whether to roll back, skip or abort for each file")
+	rootCmd.PersistentFlags().BoolVar(&keepGoing, "keep-going", false, "When rolling back several files, continue past a file that fails and report all failures at the end")
+	rootCmd.PersistentFlags().IntVarP(&jobs, "jobs", "j", 1, "In directory mode, roll back up to this many files in parallel")
+	rootCmd.PersistentFlags().BoolVar(&showDiffs, "show-diff", false, "Show the diff a rollback would apply and ask for confirmation before applying it")
+	rootCmd.PersistentFlags().StringVar(&colorMode, "color", "auto", "Color output: auto (only on a terminal, unless NO_COLOR is set), always or never")
+	rootCmd.PersistentFlags().BoolVar(&opts.NoColor, "no-color", false, "Disable colored output; same as --color never")
+	rootCmd.PersistentFlags().BoolVar(&autoBranch, "auto-branch", false, "On a protected branch, create and switch to rollback/<timestamp> instead of failing")
+	rootCmd.PersistentFlags().StringVar(&rollbackBranch, "branch", "", "Create and switch to this branch before rolling back, and commit there; 'auto' names it rollback/<timestamp>")
+	rootCmd.PersistentFlags().StringVar(&tagName, "tag", "", "Create an annotated tag at the rollback commit; supports {{.Timestamp}} (e.g. rollback-{{.Timestamp}})")
+	rootCmd.PersistentFlags().BoolVar(&forceTag, "force-tag", false, "Replace the --tag tag if it already exists")
+	rootCmd.PersistentFlags().BoolVar(&pushRollback, "push", false, "Push the branch to its upstream after rolling back")
+	rootCmd.PersistentFlags().BoolVar(&openPR, "open-pr", false, "Push, then open a GitHub pull request with the GitHub CLI (gh) into the remote's default branch; implies --push")
+	rootCmd.PersistentFlags().StringVar(&remoteName, "remote", "origin", "Remote to push to with --push")
+	rootCmd.PersistentFlags().BoolVarP(&opts.Sign, "sign", "S", false, "GPG-sign rollback commits")
+	rootCmd.PersistentFlags().StringVar(&opts.GPGKey, "gpg-key", "", "Key ID to sign with; implies --sign")
+	rootCmd.PersistentFlags().StringVar(&opts.Author, "author", "", "Author of rollback commits, as 'Name <email>' (e.g. for a CI bot)")
+	rootCmd.PersistentFlags().StringVar(&opts.Committer, "committer", "", "Committer of rollback commits, as 'Name <email>'; defaults to your git config")
+	rootCmd.PersistentFlags().StringArrayVar(&trailers, "trailer", nil, "Git trailer to add to rollback commit messages as key=value (e.g. Ticket=OPS-123); repeatable")
+	rootCmd.PersistentFlags().BoolVar(&opts.NoVerify, "no-verify", false, "Skip the pre-commit and commit-msg hooks on rollback commits; use with care, as hooks may enforce repo policy")
+	rootCmd.PersistentFlags().BoolVar(&opts.NoCommit, "no-commit", false, "Check out and stage the old version without creating a commit")
+	rootCmd.PersistentFlags().StringVar(&auditLog, "audit-log", "", "File to append a JSON line to for every file rolled back (time, user, branch, file and commits); kept across runs")
+	rootCmd.PersistentFlags().StringVar(&onComplete, "on-complete", "", "Shell command to run once after all rollbacks succeed (e.g. to trigger a sync); supports {{.Files}}, {{.Commit}} and {{.Status}}, also set as ROLLBACK_FILES, ROLLBACK_COMMIT and ROLLBACK_STATUS")
+	rootCmd.PersistentFlags().BoolVar(&onCompleteAlways, "on-complete-always", false, "Run --on-complete even if the rollback was aborted or a file failed")
+	rootCmd.PersistentFlags().StringVar(&notifyWebhook, "notify-webhook", "", "URL to POST a JSON summary of the rollback to when it finishes (e.g. a Slack incoming webhook); best effort, with a short timeout")
+	rootCmd.PersistentFlags().StringVar(&notifyOn, "notify-on", "success", "When to send --notify-webhook: success, failure or always")
+	rootCmd.PersistentFlags().BoolVar(&opts.Patch, "patch", false, "Choose which changes (hunks) to roll back interactively, with git checkout --patch, instead of restoring whole files")
+	rootCmd.PersistentFlags().BoolVar(&opts.ValidateYAML, "validate-yaml", false, "Check that each restored file is valid YAML before committing; on failure the file is restored to HEAD")
+	rootCmd.PersistentFlags().StringVar(&opts.PostRollbackCmd, "post-rollback-cmd", "", "Shell command to validate each restored file before committing (e.g. 'kubeconform \"$ROLLBACK_FILE\"'); supports {{.File}} and {{.Commit}}; on failure the file is restored to HEAD")
+	rootCmd.PersistentFlags().StringVar(&opts.Message, "message", rollback.DefaultMessage, "Commit message template; supports {{.File}} and {{.Commit}}")
+	rootCmd.PersistentFlags().StringVarP(&outputFormat, "output", "o", "text", "Output format for histories, discovered files and the rollback report: text, json or yaml")
+	rootCmd.PersistentFlags().BoolVar(&noTUI, "no-tui", false, "Choose commits by typing their number instead of with the arrow-key picker")
+	rootCmd.PersistentFlags().BoolVar(&noPager, "no-pager", false, "Never page long history listings through $PAGER")
+	rootCmd.PersistentFlags().IntVar(&opts.Retries, "retries", 0, "Retry checkouts, commits and pushes this many times, with exponential backoff, when they fail on a held index.lock or a network error")
+	rootCmd.PersistentFlags().DurationVar(&opts.WaitLock, "wait-lock", 0, "Wait up to this long (e.g. 30s) for another process to release .git/index.lock before writing to it")
+	rootCmd.PersistentFlags().BoolVar(&opts.ForceUnlock, "force-unlock", false, "Remove .git/index.lock if it is still held after --wait-lock and hasn't changed for as long")
+	rootCmd.PersistentFlags().DurationVar(&opts.Timeout, "timeout", 0, "Kill any git command that runs longer than this (e.g. 30s); 0 means no limit")
+	rootCmd.PersistentFlags().BoolVar(&opts.AllowPrompts, "allow-git-prompts", false, "Let git prompt for credentials (e.g. when pushing) instead of failing")
+	rootCmd.PersistentFlags().StringVar(&logLevel, "log-level", "", "Write structured logs to stderr at this level: debug, info, warn or error (default: no logs)")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "Structured log format: text or json")
+	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Log every git command and its exit status to stderr")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "Suppress informational output; errors are still reported")
+	rootCmd.PersistentFlags().BoolVarP(&opts.DryRun, "dry-run", "n", false, "Preview the rollback without modifying the working tree")
+	rootCmd.PersistentFlags().StringVar(&planOut, "plan-out", "", "With --dry-run, write the plan (each file, its target commit and diffstat) to this file as JSON")
 
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(os.Stderr, errorColor.Sprint("Error:"), err)
+		os.Exit(exitCode(err))
 	}
 }
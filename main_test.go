@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestMain runs the command itself when the test binary is re-executed by
+// runRollback, so its output can be checked.
+func TestMain(m *testing.M) {
+	if os.Getenv("GO_ROLLBACK_RUN_MAIN") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runRollback runs rollback with args in dir, returning what it printed on
+// stdout and stderr.
+func runRollback(t *testing.T, dir string, args ...string) (string, string) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "GO_ROLLBACK_RUN_MAIN=1", "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("rollback %v: %v\n%s", args, err, stderr.String())
+	}
+
+	return stdout.String(), stderr.String()
+}
+
+// newRepo creates a repository, on a branch that isn't protected, with
+// three versions of svc/a/rollout.yaml and svc/b/rollout.yaml.
+func newRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1")
+		if output, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, output)
+		}
+	}
+
+	run("init", "-q", "-b", "feature")
+	run("config", "user.name", "Test")
+	run("config", "user.email", "test@example.com")
+	for _, version := range []string{"1", "2", "3"} {
+		for _, file := range []string{"svc/a/rollout.yaml", "svc/b/rollout.yaml"} {
+			path := filepath.Join(dir, file)
+			if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte("v: "+version+"\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		run("add", "-A")
+		run("commit", "-q", "-m", "version "+version)
+	}
+
+	return dir
+}
+
+func TestQuietPrintsNothing(t *testing.T) {
+	tests := [][]string{
+		{"-q", "-y", "svc/a/rollout.yaml"},
+		{"-q", "-y", "-j4", "."},
+		{"-q", "-y", "--single-commit", "."},
+		{"-q", "-y", "--dry-run", "."},
+	}
+	for _, args := range tests {
+		dir := newRepo(t)
+		if stdout, _ := runRollback(t, dir, args...); stdout != "" {
+			t.Errorf("rollback %v printed on stdout:\n%s", args, stdout)
+		}
+	}
+}
+
+func TestDryRunSummary(t *testing.T) {
+	dir := newRepo(t)
+	stdout, _ := runRollback(t, dir, "-y", "--dry-run", ".")
+	if !strings.Contains(stdout, "2 would roll back, 0 skipped, 0 failed.") {
+		t.Errorf("rollback --dry-run summary:\n%s\nwant 2 files that would be rolled back", stdout)
+	}
+
+	stdout, _ = runRollback(t, dir, "-y", "--dry-run", "--output", "json", ".")
+	var report struct {
+		RolledBack    int `json:"rolled_back"`
+		WouldRollBack int `json:"would_roll_back"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Fatalf("rollback --output json printed invalid JSON: %v\n%s", err, stdout)
+	}
+	if report.RolledBack != 0 || report.WouldRollBack != 2 {
+		t.Errorf("rollback --dry-run --output json totals = %+v, want 2 that would be rolled back", report)
+	}
+}
+
+func TestSingleFileReportHistory(t *testing.T) {
+	dir := newRepo(t)
+	stdout, _ := runRollback(t, dir, "-y", "--dry-run", "--output", "json", "svc/a/rollout.yaml")
+	var report struct {
+		History []struct {
+			Subject string `json:"subject"`
+		} `json:"history"`
+	}
+	if err := json.Unmarshal([]byte(stdout), &report); err != nil {
+		t.Fatalf("rollback --output json printed invalid JSON: %v\n%s", err, stdout)
+	}
+	if len(report.History) != 3 || report.History[0].Subject != "version 3" {
+		t.Errorf("rollback --output json history = %+v, want the file's 3 commits, newest first", report.History)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gswilcox01/go-rollback/rollback"
+)
+
+// notifyTimeout bounds the webhook request, so a slow endpoint can't hold up
+// the rollback.
+const notifyTimeout = 5 * time.Second
+
+var (
+	notifyWebhook string
+	notifyOn      string
+)
+
+// notification is the JSON payload posted to --notify-webhook. Text makes it
+// show up as a message in Slack incoming webhooks.
+type notification struct {
+	Text   string        `json:"text"`
+	Status string        `json:"status"`
+	Error  string        `json:"error,omitempty"`
+	Branch string        `json:"branch,omitempty"`
+	User   string        `json:"user,omitempty"`
+	Commit string        `json:"commit,omitempty"`
+	Files  []fileOutcome `json:"files"`
+}
+
+// notify posts the outcome of the rollbacks to --notify-webhook, given the
+// error they ended with, if --notify-on selects it. It is best effort:
+// failures are only warned about, never change the result of the run.
+func notify(runErr error) {
+	if notifyWebhook == "" || opts.DryRun {
+		return
+	}
+	status := runStatus(runErr)
+	// An aborted run only notifies with --notify-on always.
+	if (notifyOn == "success" && status != "success") || (notifyOn == "failure" && status != "failed") {
+		return
+	}
+
+	payload := notification{Status: status, Branch: currentBranch, Files: []fileOutcome{}}
+	if runErr != nil {
+		payload.Error = runErr.Error()
+	}
+	payload.User, _ = rollback.User(opts)
+	if head, err := rollback.ResolveRef("HEAD", opts); err == nil {
+		payload.Commit = head.FullHash
+	}
+	outcomesMu.Lock()
+	payload.Files = append(payload.Files, outcomes...)
+	outcomesMu.Unlock()
+	payload.Text = fmt.Sprintf("Rollback %s: %d files rolled back", status, countOutcomes(statusRolledBack))
+	if payload.Branch != "" {
+		payload.Text += fmt.Sprintf(" on '%s'", payload.Branch)
+	}
+	if payload.User != "" {
+		payload.Text += " by " + payload.User
+	}
+
+	if err := postNotification(payload); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: failed to send the notification:", err)
+	}
+}
+
+func postNotification(payload notification) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), notifyTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notifyWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("the webhook responded %s", resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+
+	"github.com/gswilcox01/go-rollback/rollback"
+)
+
+var (
+	onComplete       string
+	onCompleteAlways bool
+)
+
+// completionData is what the --on-complete template can refer to.
+type completionData struct {
+	// Files are the files rolled back.
+	Files []string
+	// Commit is the full hash of HEAD once the rollbacks are done.
+	Commit string
+	// Status is "success", "failed" or "aborted".
+	Status string
+}
+
+// runStatus describes how a run that ended with err went: "success",
+// "failed" or "aborted".
+func runStatus(err error) string {
+	if errors.Is(err, errAborted) {
+		return "aborted"
+	} else if err != nil {
+		return "failed"
+	}
+	return "success"
+}
+
+// finishRollback runs what follows the rollbacks however they went, given
+// the error they ended with: closing --audit-log, --on-complete, then
+// --notify-webhook. It returns that error, or the first of theirs if there
+// was none.
+func finishRollback(err error) error {
+	if auditErr := closeAuditLog(); auditErr != nil && err == nil {
+		err = auditErr
+	}
+	if hookErr := runOnComplete(err); hookErr != nil && err == nil {
+		err = hookErr
+	} else if hookErr != nil {
+		fmt.Fprintln(os.Stderr, errorColor.Sprint("Error:"), hookErr)
+	}
+	notify(err)
+
+	return err
+}
+
+// runOnComplete runs the --on-complete command once the rollbacks are done,
+// given the error they ended with. It only runs after a successful
+// operation unless --on-complete-always is set, and never in a dry run.
+// The files, commit and status are also passed in the ROLLBACK_FILES (one
+// per line), ROLLBACK_COMMIT and ROLLBACK_STATUS environment variables.
+func runOnComplete(opErr error) error {
+	if onComplete == "" || opts.DryRun {
+		return nil
+	}
+	data := completionData{Status: runStatus(opErr)}
+	if data.Status != "success" && !onCompleteAlways {
+		return nil
+	}
+
+	outcomesMu.Lock()
+	for _, o := range outcomes {
+		if o.Status == statusRolledBack {
+			data.Files = append(data.Files, o.File)
+		}
+	}
+	outcomesMu.Unlock()
+	if head, err := rollback.ResolveRef("HEAD", opts); err == nil {
+		data.Commit = head.FullHash
+	}
+
+	tmpl, err := template.New("on-complete").Parse(onComplete)
+	if err != nil {
+		return usageErrorf("invalid --on-complete: %v", err)
+	}
+	var command strings.Builder
+	if err := tmpl.Execute(&command, data); err != nil {
+		return fmt.Errorf("failed to render the --on-complete command: %v", err)
+	}
+
+	cmd := exec.Command("sh", "-c", command.String())
+	cmd.Dir = opts.Dir
+	cmd.Env = append(os.Environ(),
+		"ROLLBACK_FILES="+strings.Join(data.Files, "\n"),
+		"ROLLBACK_COMMIT="+data.Commit,
+		"ROLLBACK_STATUS="+data.Status,
+	)
+	cmd.Stdout = infoOutput()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("--on-complete command failed: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var noPager bool
+
+// shouldPage reports whether output of the given number of lines would
+// scroll off the terminal, leaving room for the prompt that follows.
+func shouldPage(lines int) bool {
+	if noPager || quiet || outputFormat != "text" {
+		return false
+	}
+	fd := int(os.Stdout.Fd())
+	if !term.IsTerminal(fd) {
+		return false
+	}
+	_, height, err := term.GetSize(fd)
+	return err == nil && lines >= height-1
+}
+
+// page shows text through $PAGER, or less if it isn't set. Like git, less
+// is told to keep the text on screen after it exits so the listing is still
+// visible at the prompt. It falls back to printing the text directly.
+func page(text string) {
+	pager := os.Getenv("PAGER")
+	if pager == "" {
+		pager = "less"
+	}
+	cmd := exec.Command("sh", "-c", pager)
+	cmd.Stdin = strings.NewReader(text)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if os.Getenv("LESS") == "" {
+		cmd.Env = append(cmd.Env, "LESS=FRX")
+	}
+	if err := cmd.Run(); err != nil {
+		fmt.Print(text)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/gswilcox01/go-rollback/rollback"
+	"golang.org/x/term"
+)
+
+var noTUI bool
+
+// usePicker reports whether commits are chosen with the arrow-key picker
+// rather than the numbered prompt: only when someone is at a terminal to
+// use it.
+func usePicker() bool {
+	if noTUI || assumeYes || outputFormat != "text" {
+		return false
+	}
+	return term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd()))
+}
+
+// pickCommit lets the user move through the history with the arrow keys (or
+// j and k) and choose an entry with enter, starting at defaultIndex. It
+// returns the 1-based number of the entry, like the numbered prompt, or
+// errAborted for q, Esc or Ctrl-C.
+func pickCommit(filePath string, history []rollback.CommitEntry, defaultIndex int) (int, error) {
+	fd := int(os.Stdin.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read keys from the terminal: %v", err)
+	}
+	defer term.Restore(fd, state)
+
+	// Only as many entries as fit on the terminal are shown, scrolling with
+	// the cursor.
+	rows := len(history)
+	if _, height, err := term.GetSize(int(os.Stdout.Fd())); err == nil && height-3 < rows {
+		rows = max(height-3, 1)
+	}
+	cursor, top := defaultIndex-1, 0
+	drawn := 0
+	draw := func() {
+		if cursor < top {
+			top = cursor
+		} else if cursor >= top+rows {
+			top = cursor - rows + 1
+		}
+		var screen strings.Builder
+		if drawn > 0 {
+			fmt.Fprintf(&screen, "\x1b[%dA", drawn)
+		}
+		fmt.Fprintf(&screen, "\r\x1b[KChoose the commit to roll '%s' back to (↑/↓, enter; q to abort):\r\n", filePath)
+		for i := top; i < top+rows; i++ {
+			marker := "  "
+			if i == cursor {
+				marker = hashColor.Sprint("> ")
+			}
+			fmt.Fprintf(&screen, "\r\x1b[K%s%2d. %s\r\n", marker, i+1, formatEntry(history[i]))
+		}
+		drawn = rows + 1
+		fmt.Print(screen.String())
+	}
+
+	draw()
+	key := make([]byte, 3)
+	for {
+		n, err := os.Stdin.Read(key)
+		if err != nil {
+			return 0, errNoInput
+		}
+		switch string(key[:n]) {
+		case "\x1b[A", "k":
+			if cursor > 0 {
+				cursor--
+			}
+		case "\x1b[B", "j":
+			if cursor < len(history)-1 {
+				cursor++
+			}
+		case "\r", "\n":
+			return cursor + 1, nil
+		case "q", "\x1b", "\x03":
+			return 0, errAborted
+		default:
+			continue
+		}
+		draw()
+	}
+}
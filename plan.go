@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gswilcox01/go-rollback/rollback"
+)
+
+var (
+	planOut   string
+	planIn    string
+	forcePlan bool
+)
+
+// dryRunPlan is the plan the dry run made, which --plan-out saves for
+// review. Its commits are full hashes, so it means the same thing whenever
+// it is read.
+var dryRunPlan *rollback.Plan
+
+// writePlan saves the plan the dry run made to path as JSON, with each
+// file's diffstat.
+func writePlan(path string) error {
+	plan := dryRunPlan
+	if plan == nil {
+		head, err := rollback.ResolveRef("HEAD", opts)
+		if err != nil {
+			return err
+		}
+		plan = &rollback.Plan{Head: head.FullHash, Branch: currentBranch, Rollbacks: []rollback.FileRollback{}}
+	}
+	for i, r := range plan.Rollbacks {
+		if r.Delete {
+			continue
+		}
+		insertions, deletions, err := rollback.DiffStat(r.File, r.Commit, opts)
+		if err != nil {
+			return err
+		}
+		plan.Rollbacks[i].Insertions, plan.Rollbacks[i].Deletions = insertions, deletions
+	}
+
+	data, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode the plan: %v", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write the plan: %v", err)
+	}
+	infof("Wrote the plan for %d files to '%s'.\n", len(plan.Rollbacks), path)
+
+	return nil
+}
+
+// handleApply rolls back the files in a plan saved with --plan-out, to the
+// commits recorded there. A plan made at a different HEAD is refused unless
+// --force-plan is set, since the files may have changed since it was
+// reviewed.
+func handleApply(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return usageErrorf("failed to read the plan: %v", err)
+	}
+	defer f.Close()
+	plan, err := rollback.ReadPlan(f, opts)
+	if err != nil {
+		return usageErrorf("invalid plan '%s': %v", path, err)
+	}
+
+	head, err := rollback.ResolveRef("HEAD", opts)
+	if err != nil {
+		return err
+	}
+	if head.FullHash != plan.Head {
+		message := fmt.Sprintf("HEAD has moved from %.7s to %s since the plan was made, so the files may have changed since it was reviewed", plan.Head, head.Hash)
+		if !forcePlan {
+			return fmt.Errorf("%s; make a new plan, or pass --force-plan to apply this one anyway", message)
+		}
+		fmt.Fprintln(os.Stderr, "Warning:", message)
+	}
+	if len(plan.Rollbacks) == 0 {
+		infof("The plan has no files to roll back.\n")
+		return nil
+	}
+
+	deletes := false
+	for _, r := range plan.Rollbacks {
+		if r.Delete && !commitPerDir {
+			// Only RollbackFiles deletes files.
+			singleCommit = true
+		}
+		deletes = deletes || r.Delete
+		if _, err := rollback.ResolveRef(r.Commit, opts); err != nil {
+			return fmt.Errorf("invalid plan '%s': %v", path, err)
+		}
+	}
+	if deletes && opts.Strategy == "revert" {
+		return usageErrorf("the plan deletes files, which --strategy revert cannot do")
+	}
+
+	infof("Applying the plan for %d files made at %.7s...\n", len(plan.Rollbacks), plan.Head)
+	histories = map[string][]rollback.CommitEntry{}
+	if showDiffs {
+		err = showDiffsAndConfirm(plan)
+	}
+	if err == nil {
+		err = executePlan(plan)
+	}
+	if errors.Is(err, errAborted) {
+		return err
+	}
+	if reportErr := printReport(); reportErr != nil && err == nil {
+		err = reportErr
+	}
+	if failed := countOutcomes(statusFailed); err == nil && failed > 0 {
+		err = fmt.Errorf("%d of %d files failed to roll back", failed, len(plan.Rollbacks))
+	}
+
+	return err
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/term"
+)
+
+// progress shows how many of the files in a directory rollback have been
+// processed, on a line of its own at the bottom of the terminal that is
+// cleared while each file's own output is printed.
+type progress struct {
+	mu      sync.Mutex
+	done    int
+	total   int
+	enabled bool
+}
+
+// newProgress returns the progress of rolling back total files, which is
+// only shown for several files when someone is watching a terminal.
+func newProgress(total int) *progress {
+	enabled := total > 1 && !quiet && outputFormat == "text" &&
+		term.IsTerminal(int(os.Stdout.Fd())) && term.IsTerminal(int(os.Stderr.Fd()))
+	return &progress{total: total, enabled: enabled}
+}
+
+// clear removes the progress line, so output starts on a clean line.
+func (p *progress) clear() {
+	if !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprint(os.Stderr, "\r\x1b[K")
+}
+
+// advance counts n more files as processed and redraws the progress line,
+// or clears it once every file is done.
+func (p *progress) advance(n int) {
+	if !p.enabled {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done += n
+	if p.done >= p.total {
+		fmt.Fprint(os.Stderr, "\r\x1b[K")
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\r\x1b[K%d/%d files processed", p.done, p.total)
+}
+
+// writer returns w with the progress line cleared before each write, for the
+// output the rollback package prints while the files are processed.
+func (p *progress) writer(w io.Writer) io.Writer {
+	if !p.enabled {
+		return w
+	}
+	return progressWriter{p: p, w: w}
+}
+
+type progressWriter struct {
+	p *progress
+	w io.Writer
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	pw.p.clear()
+	return pw.w.Write(b)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+
+	"github.com/gswilcox01/go-rollback/rollback"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	statusRolledBack    = "rolled back"
+	statusWouldRollBack = "would roll back"
+	statusSkipped       = "skipped"
+	statusFailed        = "failed"
+)
+
+// fileOutcome is one file's entry in the report printed after rolling back
+// several files.
+type fileOutcome struct {
+	File   string `json:"file" yaml:"file"`
+	Status string `json:"status" yaml:"status"`
+	Commit string `json:"commit,omitempty" yaml:"commit,omitempty"`
+	// NewCommit is the commit that recorded the rollback.
+	NewCommit string `json:"new_commit,omitempty" yaml:"new_commit,omitempty"`
+	Reason    string `json:"reason,omitempty" yaml:"reason,omitempty"`
+
+	// deleted marks a file rolled back by deleting it.
+	deleted bool
+}
+
+var (
+	outcomesMu sync.Mutex
+	outcomes   []fileOutcome
+)
+
+// discoveredFile is a rollout file found under the directory being rolled
+// back, listed in the report with --output json or yaml.
+type discoveredFile struct {
+	File         string `json:"file" yaml:"file"`
+	LatestCommit string `json:"latest_commit,omitempty" yaml:"latest_commit,omitempty"`
+}
+
+// discovered are the files found in a directory rollback with --output json
+// or yaml, or nil for files named otherwise.
+var discovered []discoveredFile
+
+// reportHistory is the history of the file in a single-file rollback with
+// --output json or yaml, or nil for several files.
+var reportHistory []rollback.CommitEntry
+
+// recordOutcome adds a file's outcome to the report and, if it was rolled
+// back, to rolledBack. It is safe to call from concurrent rollbacks.
+func recordOutcome(outcome fileOutcome) {
+	outcomesMu.Lock()
+	defer outcomesMu.Unlock()
+	outcomes = append(outcomes, outcome)
+	if outcome.Status == statusRolledBack || outcome.Status == statusWouldRollBack {
+		rolledBack = append(rolledBack, rollback.FileRollback{File: outcome.File, Commit: outcome.Commit, Delete: outcome.deleted})
+	}
+	if outcome.Status == statusRolledBack {
+		auditRollback(outcome)
+	}
+
+	level := slog.LevelInfo
+	switch outcome.Status {
+	case statusSkipped:
+		level = slog.LevelWarn
+	case statusFailed:
+		level = slog.LevelError
+	}
+	logger.Log(context.Background(), level, "rollback "+outcome.Status, "file", outcome.File, "commit", outcome.Commit, "reason", outcome.Reason)
+}
+
+// countOutcomes returns the number of files recorded with the status.
+func countOutcomes(status string) int {
+	outcomesMu.Lock()
+	defer outcomesMu.Unlock()
+	n := 0
+	for _, o := range outcomes {
+		if o.Status == status {
+			n++
+		}
+	}
+	return n
+}
+
+// printReport lists every file's outcome with totals, as JSON or YAML with
+// --output json or yaml, where it also lists the files discovered or a single
+// file's history and is the only output on stdout.
+func printReport() error {
+	sort.SliceStable(outcomes, func(i, j int) bool { return outcomes[i].File < outcomes[j].File })
+	totals := map[string]int{}
+	for _, o := range outcomes {
+		totals[o.Status]++
+	}
+
+	if outputFormat != "text" {
+		files := outcomes
+		if files == nil {
+			files = []fileOutcome{}
+		}
+		return printStructured(struct {
+			Discovered    []discoveredFile       `json:"discovered,omitempty" yaml:"discovered,omitempty"`
+			History       []rollback.CommitEntry `json:"history,omitempty" yaml:"history,omitempty"`
+			Files         []fileOutcome          `json:"files" yaml:"files"`
+			RolledBack    int                    `json:"rolled_back" yaml:"rolled_back"`
+			WouldRollBack int                    `json:"would_roll_back" yaml:"would_roll_back"`
+			Skipped       int                    `json:"skipped" yaml:"skipped"`
+			Failed        int                    `json:"failed" yaml:"failed"`
+		}{discovered, reportHistory, files, totals[statusRolledBack], totals[statusWouldRollBack], totals[statusSkipped], totals[statusFailed]})
+	}
+
+	infof("\nSummary:\n")
+	for _, o := range outcomes {
+		switch {
+		case o.Commit != "" && o.Reason == "" && o.NewCommit != "":
+			infof("  %-16s %s -> %s in commit %s\n", o.Status, o.File, o.Commit, o.NewCommit)
+		case o.Commit != "" && o.Reason == "":
+			infof("  %-16s %s -> %s\n", o.Status, o.File, o.Commit)
+		case o.Reason != "":
+			infof("  %-16s %s (%s)\n", o.Status, o.File, o.Reason)
+		default:
+			infof("  %-16s %s\n", o.Status, o.File)
+		}
+	}
+	if opts.DryRun {
+		infof("%d would roll back, %d skipped, %d failed.\n", totals[statusWouldRollBack], totals[statusSkipped], totals[statusFailed])
+	} else {
+		infof("%d rolled back, %d skipped, %d failed.\n", totals[statusRolledBack], totals[statusSkipped], totals[statusFailed])
+	}
+
+	return nil
+}
+
+// printStructured prints v as JSON or YAML, according to --output. Each YAML
+// value starts a new document, so several make a valid stream.
+func printStructured(v any) error {
+	if outputFormat == "yaml" {
+		data, err := yaml.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("failed to encode YAML output: %v", err)
+		}
+		fmt.Printf("---\n%s", data)
+		return nil
+	}
+
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode JSON output: %v", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
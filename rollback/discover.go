@@ -0,0 +1,240 @@
+package rollback
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+func isRolloutFilename(name string, opts Options) bool {
+	for _, filename := range opts.filenames() {
+		if strings.EqualFold(name, filename) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsRolloutPath reports whether the path names a single rollout file rather
+// than a directory to search. Both / and \ separate path elements, so
+// Windows-style paths are recognized on any platform.
+func IsRolloutPath(filePath string, opts Options) bool {
+	name := filePath[strings.LastIndexAny(filePath, `/\`)+1:]
+
+	return isRolloutFilename(name, opts)
+}
+
+// matchesAnyGlob reports whether the slash-separated relative path matches any
+// of the patterns. A "**" segment matches zero or more path segments, and a
+// pattern without a slash is also tried against the last path segment.
+func matchesAnyGlob(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		pattern = strings.TrimSuffix(pattern, "/")
+		if matchGlobSegments(strings.Split(pattern, "/"), strings.Split(rel, "/")) {
+			return true
+		}
+		if !strings.Contains(pattern, "/") {
+			if matched, _ := path.Match(pattern, path.Base(rel)); matched {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func matchGlobSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchGlobSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(pattern[0], segments[0]); !matched {
+		return false
+	}
+
+	return matchGlobSegments(pattern[1:], segments[1:])
+}
+
+// FindRolloutFiles walks the directory and returns every rollout file that
+// passes the Include and Exclude filters. Paths are relative to Options.Dir,
+// like dirPath. With Options.FollowSymlinks, symlinked directories are
+// walked too, each real directory once, and files found through them are
+// returned by their real path, which is the one git knows them by.
+func FindRolloutFiles(dirPath string, opts Options) ([]string, error) {
+	root := dirPath
+	if opts.Dir != "" {
+		root = filepath.Join(opts.Dir, dirPath)
+	}
+	var files []string
+	visited := map[string]bool{}
+	var walk func(start string, viaSymlink bool) error
+	walk = func(start string, viaSymlink bool) error {
+		return filepath.Walk(start, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(root, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			isDir := info.IsDir()
+			isDirLink := false
+			if opts.FollowSymlinks && info.Mode()&os.ModeSymlink != 0 {
+				target, err := os.Stat(path)
+				isDirLink = err == nil && target.IsDir()
+			}
+			if (isDir || isDirLink) && rel != "." && opts.MaxDepth > 0 && strings.Count(rel, "/")+1 >= opts.MaxDepth {
+				return skipDir(isDir)
+			}
+			if rel != "." && matchesAnyGlob(opts.Exclude, rel) {
+				return skipDir(isDir)
+			}
+			if isDir && opts.FollowSymlinks {
+				real, err := filepath.EvalSymlinks(path)
+				if err != nil {
+					return err
+				}
+				if visited[real] {
+					return filepath.SkipDir
+				}
+				visited[real] = true
+			}
+			if isDirLink {
+				// A trailing separator makes Walk descend into the link.
+				return walk(path+string(filepath.Separator), true)
+			}
+			if !isDir && isRolloutFilename(info.Name(), opts) {
+				if len(opts.Include) > 0 && !matchesAnyGlob(opts.Include, rel) {
+					return nil
+				}
+				if viaSymlink {
+					path, err = realPath(path, opts)
+					if err != nil {
+						return err
+					}
+				} else if opts.Dir != "" {
+					path = filepath.Join(dirPath, filepath.FromSlash(rel))
+				}
+				files = append(files, path)
+			}
+			return nil
+		})
+	}
+
+	if err := walk(root, false); err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+func skipDir(isDir bool) error {
+	if isDir {
+		return filepath.SkipDir
+	}
+	return nil
+}
+
+// realPath resolves the symlinks in path, returning it relative to
+// Options.Dir.
+func realPath(path string, opts Options) (string, error) {
+	real, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", err
+	}
+	base := opts.Dir
+	if base == "" {
+		base = "."
+	}
+	base, err = filepath.EvalSymlinks(base)
+	if err != nil {
+		return "", err
+	}
+	absBase, err := filepath.Abs(base)
+	if err != nil {
+		return "", err
+	}
+	absReal, err := filepath.Abs(real)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Rel(absBase, absReal)
+}
+
+// FilterTracked splits files found under dirPath into those git tracks and
+// those it doesn't, such as untracked files and files in ignored
+// directories, with one git ls-files for the whole directory.
+func FilterTracked(dirPath string, files []string, opts Options) ([]string, []string, error) {
+	// Files found through symlinks may lie outside dirPath.
+	pathspec := []string{dirPath}
+	for _, file := range files {
+		if rel, err := filepath.Rel(dirPath, file); err != nil || strings.HasPrefix(rel, "..") {
+			pathspec = append(pathspec, file)
+		}
+	}
+	output, err := opts.git(append([]string{"-c", "core.quotePath=false", "ls-files", "--"}, pathspec...)...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to list tracked files: %v", err)
+	}
+	// ls-files may spell paths differently ("a" rather than "../dir/a"), so
+	// compare absolute paths.
+	abs := func(file string) string {
+		p, _ := filepath.Abs(filepath.Join(opts.Dir, filepath.FromSlash(file)))
+		return p
+	}
+	tracked := map[string]bool{}
+	for _, line := range strings.Split(string(output), "\n") {
+		if line != "" {
+			tracked[abs(line)] = true
+		}
+	}
+
+	var kept, skipped []string
+	for _, file := range files {
+		if tracked[abs(file)] {
+			kept = append(kept, file)
+		} else {
+			skipped = append(skipped, file)
+		}
+	}
+
+	return kept, skipped, nil
+}
+
+// ChangedFiles returns the rollout files under dirPath that differ between
+// the commits from and to, including those added, deleted or renamed in
+// between. Paths are relative to Options.Dir, like dirPath.
+func ChangedFiles(from string, to string, dirPath string, opts Options) ([]string, error) {
+	output, err := opts.git("-c", "core.quotePath=false", "diff", "--name-only", "--no-renames", "--relative", "--end-of-options", from, to, "--", dirPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files changed between %s and %s: %v", from, to, err)
+	}
+
+	var files []string
+	for _, line := range strings.Split(string(output), "\n") {
+		if line == "" || !isRolloutFilename(path.Base(line), opts) {
+			continue
+		}
+		if len(opts.Include) > 0 && !matchesAnyGlob(opts.Include, line) || matchesAnyGlob(opts.Exclude, line) {
+			continue
+		}
+		files = append(files, filepath.FromSlash(line))
+	}
+
+	return files, nil
+}
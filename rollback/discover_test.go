@@ -0,0 +1,70 @@
+package rollback
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestIsRolloutPath(t *testing.T) {
+	tests := []struct {
+		path      string
+		filenames []string
+		want      bool
+	}{
+		{"rollout.yaml", nil, true},
+		{"svc/a/rollout.yaml", nil, true},
+		{`svc\a\rollout.yaml`, nil, true},
+		{`C:\repo\svc\ROLLOUT.YAML`, nil, true},
+		{`.\rollout.yaml`, nil, true},
+		{`svc\a`, nil, false},
+		{`svc\rollout.yaml\`, nil, false},
+		{`svc\a\rollout.yaml.bak`, nil, false},
+		{`svc\a\rollout.yml`, []string{"rollout.yaml", "rollout.yml"}, true},
+		{"svc/rollout.yaml.d", nil, false},
+	}
+	for _, tt := range tests {
+		if got := IsRolloutPath(tt.path, Options{Filenames: tt.filenames}); got != tt.want {
+			t.Errorf("IsRolloutPath(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSlashPathsWith(t *testing.T) {
+	tests := []struct {
+		args []string
+		sep  byte
+		want []string
+	}{
+		{
+			[]string{"checkout", "abc123", "--", `svc\a\rollout.yaml`},
+			'\\',
+			[]string{"checkout", "abc123", "--", "svc/a/rollout.yaml"},
+		},
+		// Only paths, after "--", are converted.
+		{
+			[]string{"log", `--grep=a\b`, "--", `svc\a\rollout.yaml`, `svc\b\rollout.yaml`},
+			'\\',
+			[]string{"log", `--grep=a\b`, "--", "svc/a/rollout.yaml", "svc/b/rollout.yaml"},
+		},
+		{
+			[]string{"show", `HEAD:svc\a`},
+			'\\',
+			[]string{"show", `HEAD:svc\a`},
+		},
+		// On Unix a backslash is part of the name.
+		{
+			[]string{"checkout", "abc123", "--", `odd\name/rollout.yaml`},
+			'/',
+			[]string{"checkout", "abc123", "--", `odd\name/rollout.yaml`},
+		},
+	}
+	for _, tt := range tests {
+		args := append([]string(nil), tt.args...)
+		if got := slashPathsWith(args, tt.sep); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("slashPathsWith(%q, %q) = %q, want %q", tt.args, tt.sep, got, tt.want)
+		}
+		if !reflect.DeepEqual(args, tt.args) {
+			t.Errorf("slashPathsWith(%q, %q) modified its arguments to %q", tt.args, tt.sep, args)
+		}
+	}
+}
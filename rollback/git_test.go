@@ -0,0 +1,318 @@
+package rollback
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeRunner is a Runner that records the commands run and answers them with
+// respond, if set. It is safe to use from concurrent rollbacks.
+type fakeRunner struct {
+	mu      sync.Mutex
+	calls   [][]string
+	respond func(args []string) ([]byte, error)
+}
+
+func (r *fakeRunner) Run(args ...string) ([]byte, error) {
+	r.mu.Lock()
+	r.calls = append(r.calls, args)
+	r.mu.Unlock()
+	if r.respond == nil {
+		return nil, nil
+	}
+	return r.respond(args)
+}
+
+// RunCommand records and answers a command other than git, such as gh, as
+// Run does, with its name as the first argument.
+func (r *fakeRunner) RunCommand(name string, args ...string) ([]byte, error) {
+	return r.Run(append([]string{name}, args...)...)
+}
+
+// ran reports whether the runner ran a command with exactly these arguments.
+func (r *fakeRunner) ran(args ...string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return slices.ContainsFunc(r.calls, func(call []string) bool {
+		return slices.Equal(call, args)
+	})
+}
+
+// fakeCommit is a commit in the history a fake git log answers from.
+type fakeCommit struct {
+	entry CommitEntry
+	// files are the paths, from the work tree root, the commit changed.
+	files []string
+}
+
+// fakeLog answers git log, as FileHistory and FileHistories run it, from the
+// commits, newest first, of a repository whose working directory is at
+// prefix in the work tree.
+func fakeLog(commits []fakeCommit, prefix string) func(args []string) ([]byte, error) {
+	return func(args []string) ([]byte, error) {
+		nameOnly := slices.Contains(args, "--name-only")
+		i := slices.Index(args, "--")
+		if i < 0 || !slices.Contains(args, "log") {
+			return nil, fmt.Errorf("unexpected git command %q", args)
+		}
+		paths := map[string]bool{}
+		for _, file := range args[i+1:] {
+			paths[prefix+file] = true
+		}
+		max := len(commits)
+		if n := slices.Index(args[:i], "-n"); n >= 0 {
+			max, _ = strconv.Atoi(args[n+1])
+		}
+
+		var output strings.Builder
+		count := 0
+		for _, c := range commits {
+			if count >= max || !slices.ContainsFunc(c.files, func(f string) bool { return paths[f] }) {
+				continue
+			}
+			count++
+			e := c.entry
+			fmt.Fprintf(&output, "%s\x00%s\x00%s\x00%s\x00%s\n", e.Hash, e.FullHash, e.Author, e.Date, e.Subject)
+			if nameOnly {
+				output.WriteString(strings.Join(c.files, "\n") + "\n\n")
+			}
+		}
+		return []byte(output.String()), nil
+	}
+}
+
+// newMergeRepo creates a repository in which s/rollout.yaml had a merge
+// conflict resolved, t/rollout.yaml only changed on the merged branch and
+// u/rollout.yaml only on main.
+func newMergeRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	run := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Dir = dir
+		cmd.Env = append(os.Environ(), "GIT_CONFIG_GLOBAL=/dev/null", "GIT_CONFIG_NOSYSTEM=1")
+		if output, err := cmd.CombinedOutput(); err != nil && args[0] != "merge" {
+			t.Fatalf("git %v: %v\n%s", args, err, output)
+		}
+	}
+	write := func(file, content string) {
+		t.Helper()
+		path := filepath.Join(dir, file)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	run("init", "-q", "-b", "main")
+	run("config", "user.name", "Test")
+	run("config", "user.email", "test@example.com")
+	for _, file := range []string{"s/rollout.yaml", "t/rollout.yaml", "u/rollout.yaml"} {
+		write(file, "v: 1\n")
+	}
+	run("add", "-A")
+	run("commit", "-q", "-m", "init")
+	run("switch", "-q", "-c", "feature")
+	write("s/rollout.yaml", "v: feature\n")
+	write("t/rollout.yaml", "v: feature\n")
+	run("commit", "-q", "-a", "-m", "feature change")
+	run("switch", "-q", "main")
+	write("s/rollout.yaml", "v: main\n")
+	write("u/rollout.yaml", "v: main\n")
+	run("commit", "-q", "-a", "-m", "main change")
+	// Conflicts in s/rollout.yaml, which is then resolved by hand.
+	run("merge", "-q", "feature")
+	write("s/rollout.yaml", "v: fixed\n")
+	run("add", "-A")
+	run("commit", "-q", "-m", "merge feature with fix")
+
+	return dir
+}
+
+func TestFileHistoriesMatchesFileHistory(t *testing.T) {
+	dir := newMergeRepo(t)
+	files := []string{"s/rollout.yaml", "t/rollout.yaml", "u/rollout.yaml"}
+
+	for _, firstParent := range []bool{false, true} {
+		opts := Options{Dir: dir, NoDefaultProtected: true, FirstParent: firstParent}
+		repo, err := CheckRepo(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		histories, err := FileHistories(files, repo, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			want, err := FileHistory(file, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := histories[file]; !reflect.DeepEqual(got, want) {
+				t.Errorf("firstParent=%v: FileHistories(%s) = %v, FileHistory = %v", firstParent, file, got, want)
+			}
+		}
+	}
+
+	// The resolved merge is the current version of s/rollout.yaml.
+	history, err := FileHistory("s/rollout.yaml", Options{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) == 0 || history[0].Subject != "merge feature with fix" {
+		t.Errorf("FileHistory(s/rollout.yaml)[0] = %v, want the merge", history)
+	}
+}
+
+func TestParseHistory(t *testing.T) {
+	tests := []struct {
+		name    string
+		output  string
+		want    []CommitEntry
+		wantErr bool
+	}{
+		{name: "empty", output: "", want: nil},
+		{name: "blank", output: "\n  \n", want: nil},
+		{
+			name:   "one",
+			output: "abc1234\x00abc1234ffff\x00Jane\x002024-01-15 10:00:00\x00Fix replicas\n",
+			want:   []CommitEntry{{Hash: "abc1234", FullHash: "abc1234ffff", Author: "Jane", Date: "2024-01-15 10:00:00", Subject: "Fix replicas"}},
+		},
+		{
+			name: "commas in author and subject",
+			output: "abc1234\x00abc1234ffff\x00Doe, Jane\x002024-01-15 10:00:00\x00Bump a, b and c\n" +
+				"def5678\x00def5678ffff\x00Roe, Richard\x002024-01-14 09:00:00\x00Initial",
+			want: []CommitEntry{
+				{Hash: "abc1234", FullHash: "abc1234ffff", Author: "Doe, Jane", Date: "2024-01-15 10:00:00", Subject: "Bump a, b and c"},
+				{Hash: "def5678", FullHash: "def5678ffff", Author: "Roe, Richard", Date: "2024-01-14 09:00:00", Subject: "Initial"},
+			},
+		},
+		{
+			name:   "formatted",
+			output: "abc1234\x00abc1234ffff\x00Jane\x002024-01-15 10:00:00\x00Fix\x00abc1234 Fix (Jane)",
+			want:   []CommitEntry{{Hash: "abc1234", FullHash: "abc1234ffff", Author: "Jane", Date: "2024-01-15 10:00:00", Subject: "Fix", Formatted: "abc1234 Fix (Jane)"}},
+		},
+		{name: "too few fields", output: "abc1234\x00abc1234ffff\x00Jane", wantErr: true},
+		{name: "not a log line", output: "fatal: bad revision", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseHistory(tt.output)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: parseHistory() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: parseHistory() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestExcludeFilter(t *testing.T) {
+	revert := CommitEntry{Subject: "Revert \"bump\""}
+	bump := CommitEntry{Subject: "bump replicas"}
+	tests := []struct {
+		name  string
+		opts  Options
+		index int
+		entry CommitEntry
+		want  bool
+	}{
+		{name: "no pattern", opts: Options{}, index: 1, entry: revert, want: false},
+		{name: "match", opts: Options{ExcludeGrep: "^Revert"}, index: 1, entry: revert, want: true},
+		{name: "no match", opts: Options{ExcludeGrep: "^Revert"}, index: 1, entry: bump, want: false},
+		{name: "newest kept", opts: Options{ExcludeGrep: "^Revert"}, index: 0, entry: revert, want: false},
+		{name: "newest with before", opts: Options{ExcludeGrep: "^Revert", Before: "2024-01-01"}, index: 0, entry: revert, want: true},
+		{name: "newest with grep", opts: Options{ExcludeGrep: "^Revert", Grep: "bump"}, index: 0, entry: revert, want: true},
+	}
+	for _, tt := range tests {
+		excluded, err := excludeFilter(tt.opts)
+		if err != nil {
+			t.Fatalf("%s: excludeFilter() error = %v", tt.name, err)
+		}
+		if got := excluded(tt.index, tt.entry); got != tt.want {
+			t.Errorf("%s: excluded(%d, %q) = %v, want %v", tt.name, tt.index, tt.entry.Subject, got, tt.want)
+		}
+	}
+
+	if _, err := excludeFilter(Options{ExcludeGrep: "("}); err == nil {
+		t.Error("excludeFilter() accepted an invalid pattern")
+	}
+}
+
+func TestFileHistoriesFakeRunner(t *testing.T) {
+	entry := func(n int, subject string) CommitEntry {
+		hash := fmt.Sprintf("%07x", n)
+		return CommitEntry{Hash: hash, FullHash: hash + strings.Repeat("0", 33), Author: "Doe, Jane", Date: "2024-01-15 10:00:00", Subject: subject}
+	}
+	commits := []fakeCommit{
+		{entry(6, "Revert \"bump a\""), []string{"svc/a/rollout.yaml"}},
+		{entry(5, "bump both"), []string{"README.md", "svc/a/rollout.yaml", "svc/b/rollout.yaml"}},
+		{entry(4, "bump a"), []string{"svc/a/rollout.yaml"}},
+		{entry(3, "bump b"), []string{"svc/b/rollout.yaml"}},
+		{entry(2, "add c"), []string{"other/c/rollout.yaml"}},
+		{entry(1, "init"), []string{"svc/a/rollout.yaml", "svc/b/rollout.yaml"}},
+	}
+	tests := []struct {
+		name   string
+		prefix string
+		files  []string
+		opts   Options
+		// lengths are how many commits each file's history should have.
+		lengths []int
+	}{
+		{name: "root", files: []string{"svc/a/rollout.yaml", "svc/b/rollout.yaml", "other/c/rollout.yaml"}, lengths: []int{4, 3, 1}},
+		{name: "subdirectory", prefix: "svc/", files: []string{"a/rollout.yaml", "b/rollout.yaml"}, lengths: []int{4, 3}},
+		{name: "limit", files: []string{"svc/a/rollout.yaml", "svc/b/rollout.yaml"}, opts: Options{Limit: 2}, lengths: []int{2, 2}},
+		{name: "exclude", files: []string{"svc/a/rollout.yaml", "svc/b/rollout.yaml"}, opts: Options{ExcludeGrep: "^Revert|both"}, lengths: []int{3, 3}},
+		{name: "exclude with limit", files: []string{"svc/a/rollout.yaml"}, opts: Options{ExcludeGrep: "both", Limit: 2}, lengths: []int{2}},
+		{name: "no history", files: []string{"svc/new/rollout.yaml"}, lengths: []int{0}},
+	}
+	for _, tt := range tests {
+		opts := tt.opts
+		opts.Runner = &fakeRunner{respond: fakeLog(commits, tt.prefix)}
+		histories, err := FileHistories(tt.files, Repo{Root: "/repo", Prefix: tt.prefix}, opts)
+		if err != nil {
+			t.Fatalf("%s: FileHistories() error = %v", tt.name, err)
+		}
+		if len(histories) != len(tt.files) {
+			t.Errorf("%s: FileHistories() returned %d histories, want %d", tt.name, len(histories), len(tt.files))
+		}
+		for i, file := range tt.files {
+			if got := len(histories[file]); got != tt.lengths[i] {
+				t.Errorf("%s: FileHistories(%s) has %d commits, want %d", tt.name, file, got, tt.lengths[i])
+			}
+			want, err := FileHistory(file, opts)
+			if err != nil {
+				t.Fatalf("%s: FileHistory(%s) error = %v", tt.name, file, err)
+			}
+			if got := histories[file]; !reflect.DeepEqual(got, want) {
+				t.Errorf("%s: FileHistories(%s) = %v, FileHistory = %v", tt.name, file, got, want)
+			}
+		}
+	}
+}
+
+func TestFileHistoriesGitError(t *testing.T) {
+	runner := &fakeRunner{respond: func([]string) ([]byte, error) {
+		return nil, errors.New("fatal: not a git repository")
+	}}
+	_, err := FileHistories([]string{"rollout.yaml"}, Repo{Root: "/repo"}, Options{Runner: runner})
+	if err == nil || !strings.Contains(err.Error(), "not a git repository") {
+		t.Errorf("FileHistories() error = %v, want git's error", err)
+	}
+}
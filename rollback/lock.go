@@ -0,0 +1,58 @@
+package rollback
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// lockPollInterval is how often waitForIndexLock checks the lock file.
+const lockPollInterval = 100 * time.Millisecond
+
+// waitForIndexLock waits up to Options.WaitLock for another process to
+// release .git/index.lock. If it is still held then, ForceUnlock removes it,
+// but only if it hasn't been touched for the whole wait, so a lock a live
+// process keeps taking is left alone. The caller must hold indexMu.
+func (o Options) waitForIndexLock() error {
+	if o.WaitLock <= 0 {
+		return nil
+	}
+	output, err := o.git("rev-parse", "--git-path", "index.lock")
+	if err != nil {
+		return fmt.Errorf("failed to locate the index lock: %v", err)
+	}
+	lock := strings.TrimSpace(string(output))
+	if !filepath.IsAbs(lock) {
+		lock = filepath.Join(o.Dir, lock)
+	}
+
+	deadline := time.Now().Add(o.WaitLock)
+	for {
+		info, err := os.Stat(lock)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to check the index lock: %v", err)
+		}
+		if time.Now().Before(deadline) {
+			time.Sleep(lockPollInterval)
+			continue
+		}
+
+		if !o.ForceUnlock {
+			return fmt.Errorf("'%s' is still held after waiting %s; if no git process is running, remove it or pass --force-unlock", lock, o.WaitLock)
+		}
+		if age := time.Since(info.ModTime()); age < o.WaitLock {
+			return fmt.Errorf("'%s' is still held and was modified %s ago, so it is not stale", lock, age.Round(time.Second))
+		}
+		if err := os.Remove(lock); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove the stale index lock: %v", err)
+		}
+		if o.Logger != nil {
+			o.Logger.Warn("removed a stale index lock", "path", lock, "age", time.Since(info.ModTime()))
+		}
+		return nil
+	}
+}
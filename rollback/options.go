@@ -0,0 +1,483 @@
+// Package rollback restores rollout files to earlier versions from their git
+// history.
+package rollback
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// DefaultMessage is the commit message template used when Options.Message
+// is empty.
+const DefaultMessage = "Successfully rolled back '{{.File}}' to commit {{.Commit}}"
+
+// DefaultProtectedBranches are refused by CheckRepo unless
+// Options.NoDefaultProtected is set.
+var DefaultProtectedBranches = []string{"master", "develop", "main"}
+
+// DefaultFilenames are the rollout file names matched when
+// Options.Filenames is empty.
+var DefaultFilenames = []string{"rollout.yaml"}
+
+// Options controls how history is read, files are discovered and rollbacks
+// are applied. The zero value uses the defaults.
+type Options struct {
+	// Limit is the number of commits read from a file's history (default 10).
+	Limit int
+	// Before restricts history to commits at or before this date, in any
+	// form git accepts ("2024-01-15", "2 weeks ago").
+	Before string
+	// Since restricts history to commits after this date, in the same
+	// forms. Limit still caps how many of them are read.
+	Since string
+	// Format is a git pretty format (e.g. "%h %cd%d %s") for listing
+	// history entries, returned as CommitEntry.Formatted. It must fit on
+	// one line.
+	Format string
+	// Grep restricts history to commits whose message matches this pattern.
+	Grep string
+	// ExcludeGrep is a regular expression; commits whose subject matches it
+	// are left out of history, apart from the file's current version.
+	ExcludeGrep string
+	// FirstParent follows only the first parent of merges, so history
+	// shows the mainline commits, with merges standing for the branches
+	// they brought in.
+	FirstParent bool
+	// NoMerges leaves merge commits out of history. If a merge last
+	// changed the file, the newest entry is then not its current version.
+	NoMerges bool
+
+	// ProtectedBranches are extra branch names or globs (e.g. "release/*")
+	// on which CheckRepo refuses to run.
+	ProtectedBranches  []string
+	NoDefaultProtected bool
+	// AllowDetached lets CheckRepo succeed in a detached HEAD state.
+	AllowDetached bool
+
+	// Strategy is "checkout" (the default) or "revert".
+	Strategy string
+	// Message is a text/template for commit messages with {{.File}} and
+	// {{.Commit}}; empty uses DefaultMessage.
+	Message string
+	// PostRollbackCmd is a shell command, a text/template with {{.File}}
+	// and {{.Commit}}, run on each restored file before it is committed.
+	// If it fails the file is restored to HEAD. It requires the checkout
+	// strategy.
+	PostRollbackCmd string
+	// ValidateYAML checks that each restored file parses as YAML before it
+	// is committed. If it doesn't the file is restored to HEAD. It requires
+	// the checkout strategy.
+	ValidateYAML bool
+	// Patch restores files with git checkout --patch, so the user picks
+	// which hunks to roll back on the terminal. It requires the checkout
+	// strategy and, with a custom Runner, an InteractiveRunner.
+	Patch    bool
+	DryRun   bool
+	NoCommit bool
+	Force    bool
+	Stash    bool
+	NoColor  bool
+	// Sign GPG-signs every commit, with GPGKey if set or the default key
+	// otherwise.
+	Sign   bool
+	GPGKey string
+	// Author ("Name <email>") is recorded as the author of rollback commits,
+	// and Committer, if set, replaces the committer from git config. git
+	// revert has no --author, so reverts are attributed to Committer, or to
+	// Author when Committer is empty.
+	Author    string
+	Committer string
+	// NoVerify passes --no-verify to git commit, skipping the pre-commit and
+	// commit-msg hooks. Hooks often enforce policy, so only set it where
+	// those checks don't apply, such as automated rollbacks. git revert
+	// has no equivalent and is unaffected.
+	NoVerify bool
+	// Trailers ("Key: value") are added to the message of every rollback
+	// commit with git commit --trailer. git revert has no equivalent, so
+	// reverts don't get them.
+	Trailers []string
+
+	// Steps, Commit and Ref choose the commit BuildPlan rolls each file
+	// back to: Steps versions back, the commit in its history whose hash
+	// starts with Commit, or the revision Ref, such as a tag. With none
+	// set it is the version before the latest or, with Before or Grep, the
+	// newest commit they match, unless Choose is set.
+	Steps  int
+	Commit string
+	Ref    string
+	// DeleteMissing makes BuildPlan delete the files that did not exist at
+	// the commit selected for them, such as Ref, rather than leave them
+	// alone.
+	DeleteMissing bool
+	// Choose, if set, is called by BuildPlan for each file with its history
+	// and the full hash of the commit Steps, Commit or Ref selects, or ""
+	// if none is set. It returns the commit to roll the file back to, or
+	// "" to leave the file alone.
+	Choose func(file string, history []CommitEntry, selected string) (string, error)
+	// SingleCommit makes Execute record every rollback in one commit, and
+	// CommitPerDir in one commit per directory; deleting files needs one
+	// of them. Otherwise each file gets its own commit, with up to Jobs
+	// rolled back at once.
+	SingleCommit bool
+	CommitPerDir bool
+	Jobs         int
+	// KeepGoing makes Execute carry on past a rollback that fails, listing
+	// it in Result.Failed, instead of stopping there.
+	KeepGoing bool
+	// OnCommit, if set, is called by Execute after each commit it makes, or
+	// would make in a dry run, with the rollbacks the commit records and
+	// its full hash, or with ErrUnchanged or the error they failed with.
+	// The files in a batch that already matched their commit are reported
+	// first, with ErrUnchanged and the hash of the commit they were left out
+	// of, or "" if none was made. With Jobs above 1 it is called
+	// concurrently.
+	OnCommit func(rollbacks []FileRollback, commit string, err error)
+
+	// Filenames are matched case-insensitively during discovery.
+	Filenames []string
+	// Include and Exclude are globs matched against paths relative to the
+	// directory being searched; Exclude takes precedence.
+	Include []string
+	Exclude []string
+	// MaxDepth limits discovery to files at most this many levels below the
+	// directory, where 1 is the directory itself; 0 means no limit.
+	MaxDepth int
+	// FollowSymlinks walks into symlinked directories during discovery.
+	FollowSymlinks bool
+
+	// Dir is the repository git runs in, and file paths are relative to it;
+	// empty means the working directory. A custom Runner must honor it
+	// itself.
+	Dir string
+	// Timeout, if positive, limits how long each git command may run.
+	Timeout time.Duration
+	// Retries is how many times a git command that writes the index or
+	// commits, or a push, is tried again with exponential backoff after
+	// failing transiently on a held index.lock or a network error.
+	Retries int
+	// WaitLock is how long to wait for another process to release
+	// .git/index.lock before writing the index or committing. With
+	// ForceUnlock, a lock still held after that and untouched for as long
+	// is taken to be left by a crashed process and removed.
+	WaitLock    time.Duration
+	ForceUnlock bool
+	// AllowPrompts lets git prompt for credentials on the terminal; by
+	// default it fails instead, so unattended runs can't hang.
+	AllowPrompts bool
+	// Runner executes git; nil runs the git binary on PATH.
+	Runner Runner
+
+	// Stdout receives git output and progress messages; nil discards them.
+	Stdout io.Writer
+	// Log, if set, receives every git command line and its exit status.
+	Log io.Writer
+	// Logger, if set, receives a debug record for every git command.
+	Logger *slog.Logger
+}
+
+// indexMu serializes git commands that write the index, so rollbacks of
+// different files can run concurrently.
+var indexMu sync.Mutex
+
+// gitIndex runs a git command that modifies the index or HEAD.
+func (o Options) gitIndex(args ...string) ([]byte, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if err := o.waitForIndexLock(); err != nil {
+		return nil, err
+	}
+	return o.gitRetry(args...)
+}
+
+// gitCommit runs a git command that creates commits (commit or revert),
+// adding the identity, signing and hook flags from the options. When Sign is set
+// it then checks that HEAD really is signed. The caller must hold indexMu.
+func (o Options) gitCommit(args ...string) ([]byte, error) {
+	subcommand, rest := args[0], args[1:]
+	var prefix, flags []string
+	identity := o.Committer
+	if subcommand == "commit" && o.Author != "" {
+		flags = append(flags, "--author="+o.Author)
+	} else if identity == "" {
+		identity = o.Author
+	}
+	if identity != "" {
+		name, email, _ := parseIdentity(identity)
+		prefix = []string{"-c", "user.name=" + name, "-c", "user.email=" + email}
+	}
+	if o.Sign {
+		flag := "--gpg-sign"
+		if o.GPGKey != "" {
+			flag += "=" + o.GPGKey
+		}
+		flags = append(flags, flag)
+	}
+	if subcommand == "commit" && o.NoVerify {
+		flags = append(flags, "--no-verify")
+	}
+	if subcommand == "commit" {
+		for _, trailer := range o.Trailers {
+			flags = append(flags, "--trailer", trailer)
+		}
+	}
+
+	if err := o.waitForIndexLock(); err != nil {
+		return nil, err
+	}
+	output, err := o.gitRetry(slices.Concat(prefix, []string{subcommand}, flags, rest)...)
+	if err != nil || !o.Sign || slices.Contains(args, "--no-commit") {
+		return output, err
+	}
+
+	status, err := o.git("log", "-1", "--pretty=format:%G?")
+	if err != nil {
+		return output, fmt.Errorf("failed to verify the commit signature: %v", err)
+	}
+	if strings.TrimSpace(string(status)) == "N" {
+		return output, fmt.Errorf("the commit was created without a signature")
+	}
+
+	return output, nil
+}
+
+// trailerPattern matches a "Key: value" trailer whose key git accepts.
+var trailerPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*: *[^\s].*$`)
+
+var identityPattern = regexp.MustCompile(`^([^<>]*[^<>\s])\s*<([^<>\s]+@[^<>\s]+)>$`)
+
+// parseIdentity splits a "Name <email>" identity.
+func parseIdentity(identity string) (string, string, bool) {
+	m := identityPattern.FindStringSubmatch(strings.TrimSpace(identity))
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+func (o Options) git(args ...string) ([]byte, error) {
+	return o.logRun("git", slashPaths(args), o.runner().Run)
+}
+
+// gh runs the GitHub CLI through the Runner, which must be a CommandRunner,
+// so it runs in Dir with the timeout and logging git gets.
+func (o Options) gh(args ...string) ([]byte, error) {
+	commands, ok := o.runner().(CommandRunner)
+	if !ok {
+		return nil, fmt.Errorf("the runner cannot run the GitHub CLI (gh)")
+	}
+	return o.logRun("gh", args, func(args ...string) ([]byte, error) {
+		return commands.RunCommand("gh", args...)
+	})
+}
+
+func (o Options) runner() Runner {
+	if o.Runner != nil {
+		return o.Runner
+	}
+	return execRunner{dir: o.Dir, timeout: o.Timeout, prompts: o.AllowPrompts}
+}
+
+// logRun runs the named command with run, logging it to Log and Logger.
+func (o Options) logRun(name string, args []string, run func(args ...string) ([]byte, error)) ([]byte, error) {
+	if o.Log == nil && o.Logger == nil {
+		return run(args...)
+	}
+
+	if o.Log != nil {
+		fmt.Fprintf(o.Log, "+ %s\n", commandLine(name, args))
+	}
+	start := time.Now()
+	output, err := run(args...)
+	if o.Log != nil {
+		fmt.Fprintf(o.Log, "+ exit status %d\n", exitCode(err))
+	}
+	if o.Logger != nil {
+		o.Logger.Debug("ran "+name, "command", commandLine(name, args), "exit_status", exitCode(err), "duration", time.Since(start))
+	}
+	return output, err
+}
+
+// slashPaths converts the paths in git arguments, everything after "--", to
+// forward slashes: git wants them in pathspecs, but Windows paths use
+// backslashes.
+func slashPaths(args []string) []string {
+	return slashPathsWith(args, filepath.Separator)
+}
+
+// slashPathsWith is slashPaths for a platform whose separator is sep.
+func slashPathsWith(args []string, sep byte) []string {
+	if i := slices.Index(args, "--"); i >= 0 && sep != '/' {
+		args = slices.Clone(args)
+		for j := i + 1; j < len(args); j++ {
+			args[j] = strings.ReplaceAll(args[j], string(sep), "/")
+		}
+	}
+	return args
+}
+
+// gitInteractive runs git like Options.git, but attached to the terminal so
+// the user can answer it, with indexMu held as for gitIndex.
+func (o Options) gitInteractive(args ...string) error {
+	var runner Runner = execRunner{dir: o.Dir, prompts: o.AllowPrompts}
+	if o.Runner != nil {
+		runner = o.Runner
+	}
+	interactive, ok := runner.(InteractiveRunner)
+	if !ok {
+		return fmt.Errorf("the runner cannot run git interactively")
+	}
+
+	args = slashPaths(args)
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if err := o.waitForIndexLock(); err != nil {
+		return err
+	}
+	if o.Log != nil {
+		fmt.Fprintf(o.Log, "+ %s\n", commandLine("git", args))
+	}
+	start := time.Now()
+	err := interactive.RunInteractive(args...)
+	if o.Log != nil {
+		fmt.Fprintf(o.Log, "+ exit status %d\n", exitCode(err))
+	}
+	if o.Logger != nil {
+		o.Logger.Debug("ran git", "command", commandLine("git", args), "exit_status", exitCode(err), "duration", time.Since(start))
+	}
+	return err
+}
+
+func (o Options) limit() int {
+	if o.Limit == 0 {
+		return 10
+	}
+	return o.Limit
+}
+
+func (o Options) strategy() string {
+	if o.Strategy == "" {
+		return "checkout"
+	}
+	return o.Strategy
+}
+
+func (o Options) filenames() []string {
+	if len(o.Filenames) == 0 {
+		return DefaultFilenames
+	}
+	return o.Filenames
+}
+
+func (o Options) stdout() io.Writer {
+	if o.Stdout == nil {
+		return io.Discard
+	}
+	return o.Stdout
+}
+
+func (o Options) messageTemplate() (*template.Template, error) {
+	text := o.Message
+	if text == "" {
+		text = DefaultMessage
+	}
+
+	return template.New("message").Parse(text)
+}
+
+// Validate checks the options for errors before any git operation runs.
+func (o Options) Validate() error {
+	if o.Limit < 0 {
+		return fmt.Errorf("invalid limit %d: must be a positive integer", o.Limit)
+	}
+	if o.Steps < 0 {
+		return fmt.Errorf("invalid steps %d: must not be negative", o.Steps)
+	}
+	if o.SingleCommit && o.CommitPerDir {
+		return fmt.Errorf("a single commit and a commit per directory cannot both be made")
+	}
+	if (o.SingleCommit || o.CommitPerDir) && o.strategy() == "revert" {
+		return fmt.Errorf("batching rollbacks into commits requires the checkout strategy")
+	}
+	if o.MaxDepth < 0 {
+		return fmt.Errorf("invalid max depth %d: must not be negative", o.MaxDepth)
+	}
+	if o.Retries < 0 {
+		return fmt.Errorf("invalid retries %d: must not be negative", o.Retries)
+	}
+	if o.WaitLock < 0 {
+		return fmt.Errorf("invalid lock wait %s: must not be negative", o.WaitLock)
+	}
+	if o.ForceUnlock && o.WaitLock == 0 {
+		return fmt.Errorf("force unlock requires a lock wait, which sets how old a stale lock must be")
+	}
+	if o.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %s: must not be negative", o.Timeout)
+	}
+	if strings.Contains(o.Format, "\n") || strings.Contains(o.Format, "%n") || strings.Contains(strings.ToLower(o.Format), "%x0a") || strings.Contains(o.Format, "%x00") {
+		return fmt.Errorf("invalid format '%s': must not contain newlines or NUL bytes", o.Format)
+	}
+	if s := o.strategy(); s != "checkout" && s != "revert" {
+		return fmt.Errorf("invalid strategy '%s': must be 'checkout' or 'revert'", s)
+	}
+
+	tmpl, err := o.messageTemplate()
+	if err == nil {
+		err = tmpl.Execute(io.Discard, messageData{})
+	}
+	if err != nil {
+		return fmt.Errorf("invalid message template: %v", err)
+	}
+
+	if _, err := regexp.Compile(o.ExcludeGrep); err != nil {
+		return fmt.Errorf("invalid exclude pattern '%s': %v", o.ExcludeGrep, err)
+	}
+	if o.PostRollbackCmd != "" {
+		if o.strategy() == "revert" {
+			return fmt.Errorf("a post-rollback command requires the checkout strategy")
+		}
+		if _, err := template.New("post-rollback").Parse(o.PostRollbackCmd); err != nil {
+			return fmt.Errorf("invalid post-rollback command: %v", err)
+		}
+	}
+
+	if o.ValidateYAML && o.strategy() == "revert" {
+		return fmt.Errorf("validating YAML requires the checkout strategy")
+	}
+	if o.Patch && o.strategy() == "revert" {
+		return fmt.Errorf("patch mode requires the checkout strategy")
+	}
+
+	for _, trailer := range o.Trailers {
+		if !trailerPattern.MatchString(trailer) {
+			return fmt.Errorf("invalid trailer '%s': must be of the form 'Key: value'", trailer)
+		}
+	}
+
+	for _, identity := range []string{o.Author, o.Committer} {
+		if _, _, ok := parseIdentity(identity); identity != "" && !ok {
+			return fmt.Errorf("invalid identity '%s': must be of the form 'Name <email>'", identity)
+		}
+	}
+
+	for _, pattern := range append(append([]string{}, o.Include...), o.Exclude...) {
+		if _, err := path.Match(strings.ReplaceAll(pattern, "**", "*"), ""); err != nil {
+			return fmt.Errorf("invalid glob pattern '%s': %v", pattern, err)
+		}
+	}
+	for _, pattern := range o.ProtectedBranches {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid protected branch pattern '%s': %v", pattern, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,392 @@
+package rollback
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+)
+
+// Plan is what a rollback would do, computed without changing anything:
+// each file to roll back with the full hash of its target commit, and the
+// files left alone. It can be saved as JSON and read back with ReadPlan.
+type Plan struct {
+	// Head is the full hash of HEAD when the plan was built, and Branch the
+	// branch then checked out, or "" on a detached HEAD.
+	Head      string         `json:"head"`
+	Branch    string         `json:"branch,omitempty"`
+	Rollbacks []FileRollback `json:"files"`
+	Skipped   []SkippedFile  `json:"skipped,omitempty"`
+	// Histories is each file's history, as BuildPlan read it; it isn't
+	// saved.
+	Histories map[string][]CommitEntry `json:"-"`
+
+	opts Options
+}
+
+// SkippedFile is a file a plan leaves alone, and why.
+type SkippedFile struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// Result is what Execute did: the files rolled back, those that already
+// matched their target commit, and those that failed.
+// Commits maps each file rolled back to the full hash of the commit that
+// recorded it, unless NoCommit or DryRun was set.
+type Result struct {
+	RolledBack []FileRollback
+	Unchanged  []FileRollback
+	Failed     []FileRollback
+	Commits    map[string]string
+}
+
+// ReadPlan reads a plan saved as JSON, to be executed with opts.
+func ReadPlan(r io.Reader, opts Options) (*Plan, error) {
+	plan := &Plan{}
+	if err := json.NewDecoder(r).Decode(plan); err != nil {
+		return nil, err
+	}
+	if plan.Head == "" {
+		return nil, errors.New("no head commit recorded")
+	}
+	plan.opts = opts
+
+	return plan, nil
+}
+
+// WithOptions returns a copy of the plan to be executed with opts instead.
+func (p *Plan) WithOptions(opts Options) *Plan {
+	plan := *p
+	plan.Rollbacks = slices.Clone(p.Rollbacks)
+	plan.Skipped = slices.Clone(p.Skipped)
+	plan.opts = opts
+
+	return &plan
+}
+
+// BuildPlan resolves the paths, each a file or a directory to search for
+// tracked rollout files, and picks every file's target commit with Steps,
+// Commit, Ref and Choose. A protected current branch doesn't stop planning;
+// Execute refuses it instead.
+func BuildPlan(paths []string, opts Options) (*Plan, error) {
+	repo, err := CheckRepo(opts)
+	var protected *ProtectedBranchError
+	if err != nil && !errors.As(err, &protected) {
+		return nil, err
+	}
+	head, err := ResolveRef("HEAD", opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, p := range paths {
+		if info, err := os.Stat(filepath.Join(opts.Dir, p)); err != nil || !info.IsDir() {
+			files = append(files, p)
+			continue
+		}
+		found, err := FindRolloutFiles(p, opts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to walk '%s': %v", p, err)
+		}
+		tracked, _, err := FilterTracked(p, found, opts)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, tracked...)
+	}
+
+	histories, err := FileHistories(files, repo, opts)
+	if err != nil {
+		return nil, err
+	}
+	var ref CommitEntry
+	if opts.Ref != "" {
+		if ref, err = ResolveRef(opts.Ref, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	plan := &Plan{Head: head.FullHash, Branch: repo.Branch, Rollbacks: []FileRollback{}, Histories: histories, opts: opts}
+	skip := func(file, reason string) {
+		plan.Skipped = append(plan.Skipped, SkippedFile{File: file, Reason: reason})
+	}
+	// missing reports whether the file did not exist at commit, such as the
+	// commit that deleted it, planning to delete it with DeleteMissing or
+	// else skipping it, naming the commit as given.
+	missing := func(file, commit, name string) (bool, error) {
+		exists, err := ExistsAt(file, commit, opts)
+		if err != nil || exists {
+			return false, err
+		}
+		if opts.DeleteMissing {
+			plan.Rollbacks = append(plan.Rollbacks, FileRollback{File: file, Commit: commit, Delete: true})
+		} else {
+			skip(file, "did not exist at "+name)
+		}
+		return true, nil
+	}
+	for _, file := range files {
+		history := histories[file]
+		var selected, reason string
+		if opts.Ref != "" {
+			// A file missing at Ref is left to DeleteMissing without asking.
+			if gone, err := missing(file, ref.FullHash, opts.Ref); err != nil {
+				return nil, err
+			} else if gone {
+				continue
+			}
+			selected = ref.FullHash
+		} else {
+			selected, reason = selectCommit(history, opts)
+		}
+		if reason != "" {
+			skip(file, reason)
+			continue
+		}
+		if opts.Choose != nil {
+			chosen, err := opts.Choose(file, history, selected)
+			if err != nil {
+				return nil, err
+			}
+			if chosen == "" {
+				skip(file, "left as it is")
+				continue
+			}
+			if selected, err = fullHash(chosen, history, opts); err != nil {
+				return nil, err
+			}
+		}
+		if opts.Ref == "" || selected != ref.FullHash {
+			if gone, err := missing(file, selected, shortHash(selected, history)); err != nil {
+				return nil, err
+			} else if gone {
+				continue
+			}
+		}
+		plan.Rollbacks = append(plan.Rollbacks, FileRollback{File: file, Commit: selected})
+	}
+
+	return plan, nil
+}
+
+// selectCommit returns the full hash of the commit in a file's history
+// that Steps or Commit select or, unless Choose is set, the version before
+// the latest or, with Before or Grep, the newest commit they match.
+// It returns "" when nothing is selected, with the reason if the history
+// has no such commit.
+func selectCommit(history []CommitEntry, opts Options) (string, string) {
+	steps := opts.Steps
+	switch {
+	case opts.Commit != "":
+		entry, err := FindCommit(history, opts.Commit)
+		if err != nil {
+			return "", err.Error()
+		}
+		return entry.FullHash, ""
+	case steps == 0 && opts.Choose != nil:
+		return "", ""
+	case steps == 0 && (opts.Before != "" || opts.Grep != ""):
+		if len(history) == 0 {
+			return "", "no commit in the file's history matches"
+		}
+		return history[0].FullHash, ""
+	case steps == 0:
+		steps = 1
+	}
+	if steps >= len(history) {
+		return "", fmt.Sprintf("cannot go back %d steps: only %d commits in the file's history", steps, len(history))
+	}
+
+	return history[steps].FullHash, ""
+}
+
+// fullHash returns the full hash of a commit, looking it up in the file's
+// history before asking git.
+func fullHash(commit string, history []CommitEntry, opts Options) (string, error) {
+	if entry, err := FindCommit(history, commit); err == nil {
+		return entry.FullHash, nil
+	}
+	entry, err := ResolveRef(commit, opts)
+	if err != nil {
+		return "", err
+	}
+
+	return entry.FullHash, nil
+}
+
+// shortHash returns the abbreviated hash of a commit in the file's history,
+// as the history shows it, or the full hash if it isn't there.
+func shortHash(commit string, history []CommitEntry) string {
+	for _, entry := range history {
+		if entry.FullHash == commit {
+			return entry.Hash
+		}
+	}
+
+	return commit
+}
+
+// Execute rolls back every file in the plan with the options it was built
+// with: one commit per file, with up to Jobs at once, unless SingleCommit
+// or CommitPerDir batches them. It stops at the first failure unless
+// KeepGoing is set, returning what was done so far alongside the error.
+// With DryRun each rollback is only described.
+func Execute(plan *Plan) (*Result, error) {
+	opts := plan.opts
+	if !opts.DryRun {
+		if _, err := CheckRepo(opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// A dry run describes each file on its own.
+	batched := (opts.SingleCommit || opts.CommitPerDir) && !opts.DryRun
+	var batches [][]FileRollback
+	switch {
+	case batched && opts.CommitPerDir:
+		batches = groupByDir(plan.Rollbacks)
+	case batched && len(plan.Rollbacks) > 0:
+		batches = [][]FileRollback{plan.Rollbacks}
+	case opts.DryRun:
+		for _, r := range plan.Rollbacks {
+			batches = append(batches, []FileRollback{r})
+		}
+	default:
+		for _, r := range plan.Rollbacks {
+			if r.Delete {
+				return nil, fmt.Errorf("'%s': deleting files requires SingleCommit or CommitPerDir", r.File)
+			}
+			batches = append(batches, []FileRollback{r})
+		}
+	}
+
+	result := &Result{Commits: map[string]string{}}
+	var mu sync.Mutex
+	var firstErr error
+	// run rolls back one batch, reporting whether to go on.
+	run := func(batch []FileRollback) bool {
+		hash, unchanged, err := executeBatch(batch, opts)
+		if err == nil && len(unchanged) > 0 {
+			// The files already at their commit were left out of it.
+			batch = slices.DeleteFunc(slices.Clone(batch), func(r FileRollback) bool { return slices.Contains(unchanged, r) })
+			if opts.OnCommit != nil {
+				opts.OnCommit(unchanged, hash, ErrUnchanged)
+			}
+		}
+		if opts.OnCommit != nil {
+			opts.OnCommit(batch, hash, err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		result.Unchanged = append(result.Unchanged, unchanged...)
+		switch {
+		case errors.Is(err, ErrUnchanged):
+		case err != nil:
+			result.Failed = append(result.Failed, batch...)
+			if firstErr == nil {
+				firstErr = batchError(batch, opts, err)
+			}
+		default:
+			result.RolledBack = append(result.RolledBack, batch...)
+			for _, r := range batch {
+				if hash != "" {
+					result.Commits[r.File] = hash
+				}
+			}
+		}
+		return firstErr == nil || opts.KeepGoing
+	}
+
+	if opts.Jobs > 1 && len(batches) > 1 && !batched {
+		work := make(chan []FileRollback)
+		var wg sync.WaitGroup
+		for i := 0; i < opts.Jobs; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for batch := range work {
+					run(batch)
+				}
+			}()
+		}
+		for _, batch := range batches {
+			mu.Lock()
+			stop := firstErr != nil && !opts.KeepGoing
+			mu.Unlock()
+			if stop {
+				break
+			}
+			work <- batch
+		}
+		close(work)
+		wg.Wait()
+	} else {
+		for _, batch := range batches {
+			if !run(batch) {
+				break
+			}
+		}
+	}
+
+	if opts.KeepGoing {
+		return result, nil
+	}
+	return result, firstErr
+}
+
+// executeBatch rolls back the files in one commit, or describes doing so
+// in a dry run, where every batch is a single file. It returns the commit
+// and the rollbacks left out of it because their files already matched.
+func executeBatch(batch []FileRollback, opts Options) (string, []FileRollback, error) {
+	switch {
+	case opts.DryRun && batch[0].Delete:
+		fmt.Fprintf(opts.stdout(), "[dry-run] Would delete '%s', which did not exist at commit %s\n", batch[0].File, batch[0].Commit)
+		return "", nil, nil
+	case opts.DryRun || (!opts.SingleCommit && !opts.CommitPerDir):
+		hash, err := RollbackFile(batch[0].File, batch[0].Commit, opts)
+		if errors.Is(err, ErrUnchanged) {
+			return "", batch, err
+		}
+		return hash, nil, err
+	default:
+		return RollbackFiles(batch, opts)
+	}
+}
+
+// batchError describes a batch that failed to roll back.
+func batchError(batch []FileRollback, opts Options, err error) error {
+	switch {
+	case opts.CommitPerDir && !opts.DryRun:
+		return fmt.Errorf("failed to roll back in '%s': %v", filepath.Dir(batch[0].File), err)
+	case opts.SingleCommit && !opts.DryRun:
+		return fmt.Errorf("failed to roll back: %v", err)
+	default:
+		return fmt.Errorf("failed to roll back '%s': %v", batch[0].File, err)
+	}
+}
+
+// groupByDir groups the rollbacks by the directory holding each file, such
+// as a service's directory in a monorepo, in the order the directories are
+// first seen.
+func groupByDir(rollbacks []FileRollback) [][]FileRollback {
+	var groups [][]FileRollback
+	index := map[string]int{}
+	for _, r := range rollbacks {
+		dir := filepath.Dir(r.File)
+		i, ok := index[dir]
+		if !ok {
+			i = len(groups)
+			index[dir] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], r)
+	}
+
+	return groups
+}
@@ -0,0 +1,395 @@
+package rollback
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// exitError is an error from git exiting with a status, as a fake Runner
+// returns it.
+type exitError int
+
+func (e exitError) Error() string { return fmt.Sprintf("exit status %d", int(e)) }
+func (e exitError) ExitCode() int { return int(e) }
+
+// planCommits is the history of a repository where svc/a/rollout.yaml has
+// been changed three times and svc/b/rollout.yaml, added later, twice.
+var planCommits = []fakeCommit{
+	{planEntry(4, "bump a and b"), []string{"svc/a/rollout.yaml", "svc/b/rollout.yaml"}},
+	{planEntry(3, "bump a"), []string{"svc/a/rollout.yaml"}},
+	{planEntry(2, "add b"), []string{"svc/b/rollout.yaml"}},
+	{planEntry(1, "init"), []string{"svc/a/rollout.yaml"}},
+}
+
+func planEntry(n int, subject string) CommitEntry {
+	hash := fmt.Sprintf("%07x", n)
+	return CommitEntry{Hash: hash, FullHash: hash + strings.Repeat("0", 33), Author: "Doe, Jane", Date: "2024-01-15 10:00:00", Subject: subject}
+}
+
+// fakeRepo answers the git commands BuildPlan and Execute run, for the
+// repository planCommits describes, checked out on branch feature.
+type fakeRepo struct {
+	// unchanged are the files that already match every commit, and fail
+	// those whose checkout fails.
+	unchanged map[string]bool
+	fail      map[string]bool
+	// deleted maps files to the commit that deleted them.
+	deleted map[string]string
+}
+
+func (f fakeRepo) respond(args []string) ([]byte, error) {
+	raw := args
+	for len(args) > 2 && args[0] == "-c" {
+		args = args[2:]
+	}
+	paths := []string{}
+	if i := slices.Index(args, "--"); i >= 0 {
+		paths = args[i+1:]
+	}
+	switch {
+	case args[0] == "rev-parse" && args[1] == "--is-inside-work-tree":
+		return []byte("true\n/repo\n\n"), nil
+	case args[0] == "branch":
+		return []byte("feature\n"), nil
+	case args[0] == "rev-parse" && args[1] == "HEAD":
+		return []byte("c0ffee" + strings.Repeat("0", 34) + "\n"), nil
+	case args[0] == "log" && slices.Contains(args, "--no-walk"):
+		ref := strings.TrimSuffix(args[slices.Index(args, "--end-of-options")+1], "^{commit}")
+		for _, c := range planCommits {
+			if ref == "HEAD" || strings.HasPrefix(c.entry.FullHash, ref) {
+				e := c.entry
+				return []byte(fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\n", e.Hash, e.FullHash, e.Author, e.Date, e.Subject)), nil
+			}
+		}
+		return nil, exitError(128)
+	case args[0] == "log" && slices.Contains(args, "--pretty=format:%s"):
+		return []byte("a subject"), nil
+	case args[0] == "log":
+		return fakeLog(planCommits, "")(raw)
+	case args[0] == "cat-file":
+		commit, file, _ := strings.Cut(args[2], ":./")
+		if f.deleted[file] == commit {
+			return nil, exitError(128)
+		}
+		for _, c := range slices.Backward(planCommits) {
+			if slices.Contains(c.files, file) {
+				if c.entry.FullHash <= commit {
+					return nil, nil
+				}
+				break
+			}
+		}
+		return nil, exitError(128)
+	case args[0] == "diff" && slices.Contains(args, "--quiet"):
+		for _, file := range paths {
+			if !f.unchanged[file] {
+				return nil, exitError(1)
+			}
+		}
+		return nil, nil
+	case args[0] == "checkout" && args[1] != "HEAD" && f.fail[paths[0]]:
+		return nil, errors.New("boom")
+	}
+
+	return nil, nil
+}
+
+func TestBuildPlan(t *testing.T) {
+	a, b := "svc/a/rollout.yaml", "svc/b/rollout.yaml"
+	full := func(n int) string { return planEntry(n, "").FullHash }
+	tests := []struct {
+		name    string
+		opts    Options
+		repo    fakeRepo
+		want    []FileRollback
+		skipped []SkippedFile
+	}{
+		{
+			name: "version before the latest",
+			want: []FileRollback{{File: a, Commit: full(3)}, {File: b, Commit: full(2)}},
+		},
+		{
+			name:    "steps",
+			opts:    Options{Steps: 2},
+			want:    []FileRollback{{File: a, Commit: full(1)}},
+			skipped: []SkippedFile{{File: b, Reason: "cannot go back 2 steps: only 2 commits in the file's history"}},
+		},
+		{
+			name:    "commit",
+			opts:    Options{Commit: "0000003"},
+			want:    []FileRollback{{File: a, Commit: full(3)}},
+			skipped: []SkippedFile{{File: b, Reason: "commit '0000003' not found in the file's history"}},
+		},
+		{
+			name:    "ref",
+			opts:    Options{Ref: "0000001"},
+			want:    []FileRollback{{File: a, Commit: full(1)}},
+			skipped: []SkippedFile{{File: b, Reason: "did not exist at 0000001"}},
+		},
+		{
+			name: "ref with delete missing",
+			opts: Options{Ref: "0000001", DeleteMissing: true},
+			want: []FileRollback{{File: a, Commit: full(1)}, {File: b, Commit: full(1), Delete: true}},
+		},
+		{
+			name:    "commit that deleted the file",
+			repo:    fakeRepo{deleted: map[string]string{a: full(3)}},
+			want:    []FileRollback{{File: b, Commit: full(2)}},
+			skipped: []SkippedFile{{File: a, Reason: "did not exist at 0000003"}},
+		},
+		{
+			name: "commit that deleted the file with delete missing",
+			opts: Options{DeleteMissing: true},
+			repo: fakeRepo{deleted: map[string]string{a: full(3)}},
+			want: []FileRollback{{File: a, Commit: full(3), Delete: true}, {File: b, Commit: full(2)}},
+		},
+		{
+			name: "chosen commit that deleted the file",
+			opts: Options{Choose: func(file string, history []CommitEntry, selected string) (string, error) {
+				return history[1].Hash, nil
+			}},
+			repo:    fakeRepo{deleted: map[string]string{b: full(2)}},
+			want:    []FileRollback{{File: a, Commit: full(3)}},
+			skipped: []SkippedFile{{File: b, Reason: "did not exist at 0000002"}},
+		},
+		{
+			name: "choose",
+			opts: Options{Steps: 1, Choose: func(file string, history []CommitEntry, selected string) (string, error) {
+				if file == a {
+					return "", nil
+				}
+				// Abbreviated hashes are resolved to full ones.
+				return history[len(history)-1].Hash, nil
+			}},
+			want:    []FileRollback{{File: b, Commit: full(2)}},
+			skipped: []SkippedFile{{File: a, Reason: "left as it is"}},
+		},
+	}
+	for _, tt := range tests {
+		opts := tt.opts
+		opts.Runner = &fakeRunner{respond: tt.repo.respond}
+		plan, err := BuildPlan([]string{a, b}, opts)
+		if err != nil {
+			t.Fatalf("%s: BuildPlan() error = %v", tt.name, err)
+		}
+		if plan.Head != full(4) || plan.Branch != "feature" {
+			t.Errorf("%s: BuildPlan() head = %s on %q, want %s on feature", tt.name, plan.Head, plan.Branch, full(4))
+		}
+		if !reflect.DeepEqual(plan.Rollbacks, tt.want) {
+			t.Errorf("%s: BuildPlan() rollbacks = %v, want %v", tt.name, plan.Rollbacks, tt.want)
+		}
+		if !reflect.DeepEqual(plan.Skipped, tt.skipped) {
+			t.Errorf("%s: BuildPlan() skipped = %v, want %v", tt.name, plan.Skipped, tt.skipped)
+		}
+	}
+}
+
+func TestBuildPlanChooseSelected(t *testing.T) {
+	var selected []string
+	opts := Options{Steps: 1, Runner: &fakeRunner{respond: fakeRepo{}.respond}}
+	opts.Choose = func(file string, history []CommitEntry, commit string) (string, error) {
+		selected = append(selected, commit)
+		return commit, nil
+	}
+	if _, err := BuildPlan([]string{"svc/a/rollout.yaml"}, opts); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{planEntry(3, "").FullHash}; !slices.Equal(selected, want) {
+		t.Errorf("BuildPlan() offered Choose %v, want %v", selected, want)
+	}
+
+	opts.Choose = func(string, []CommitEntry, string) (string, error) { return "", errors.New("aborted") }
+	if _, err := BuildPlan([]string{"svc/a/rollout.yaml"}, opts); err == nil || err.Error() != "aborted" {
+		t.Errorf("BuildPlan() error = %v, want Choose's", err)
+	}
+}
+
+func TestExecute(t *testing.T) {
+	a, b, c := "svc/a/rollout.yaml", "svc/b/rollout.yaml", "svc/a/rollout.yml"
+	rollbacks := []FileRollback{{File: a, Commit: "0000003"}, {File: b, Commit: "0000002"}, {File: c, Commit: "0000002"}}
+	tests := []struct {
+		name string
+		opts Options
+		repo fakeRepo
+		// batches are the files, in order, OnCommit is called with.
+		batches    [][]string
+		rolledBack []string
+		unchanged  []string
+		failed     []string
+		// commits are how many commits are created.
+		commits int
+		wantErr string
+	}{
+		{
+			name:       "one commit per file",
+			batches:    [][]string{{a}, {b}, {c}},
+			rolledBack: []string{a, b, c},
+			commits:    3,
+		},
+		{
+			name:       "unchanged",
+			repo:       fakeRepo{unchanged: map[string]bool{b: true}},
+			batches:    [][]string{{a}, {b}, {c}},
+			rolledBack: []string{a, c},
+			unchanged:  []string{b},
+			commits:    2,
+		},
+		{
+			name:       "stops at a failure",
+			repo:       fakeRepo{fail: map[string]bool{b: true}},
+			batches:    [][]string{{a}, {b}},
+			rolledBack: []string{a},
+			failed:     []string{b},
+			commits:    1,
+			wantErr:    "failed to roll back 'svc/b/rollout.yaml': failed to checkout commit: boom",
+		},
+		{
+			name:       "keep going",
+			opts:       Options{KeepGoing: true},
+			repo:       fakeRepo{fail: map[string]bool{b: true}},
+			batches:    [][]string{{a}, {b}, {c}},
+			rolledBack: []string{a, c},
+			failed:     []string{b},
+			commits:    2,
+		},
+		{
+			name:       "jobs",
+			opts:       Options{Jobs: 2, KeepGoing: true},
+			repo:       fakeRepo{fail: map[string]bool{b: true}},
+			batches:    [][]string{{a}, {b}, {c}},
+			rolledBack: []string{a, c},
+			failed:     []string{b},
+			commits:    2,
+		},
+		{
+			name:       "single commit",
+			opts:       Options{SingleCommit: true},
+			batches:    [][]string{{a, b, c}},
+			rolledBack: []string{a, b, c},
+			commits:    1,
+		},
+		{
+			name:       "single commit leaves out unchanged files",
+			opts:       Options{SingleCommit: true},
+			repo:       fakeRepo{unchanged: map[string]bool{b: true}},
+			batches:    [][]string{{b}, {a, c}},
+			rolledBack: []string{a, c},
+			unchanged:  []string{b},
+			commits:    1,
+		},
+		{
+			name:      "single commit with every file unchanged",
+			opts:      Options{SingleCommit: true},
+			repo:      fakeRepo{unchanged: map[string]bool{a: true, b: true, c: true}},
+			batches:   [][]string{{a, b, c}},
+			unchanged: []string{a, b, c},
+		},
+		{
+			name:       "commit per dir",
+			opts:       Options{CommitPerDir: true},
+			batches:    [][]string{{a, c}, {b}},
+			rolledBack: []string{a, b, c},
+			commits:    2,
+		},
+		{
+			name:    "batch fails",
+			opts:    Options{SingleCommit: true},
+			repo:    fakeRepo{fail: map[string]bool{c: true}},
+			batches: [][]string{{a, b, c}},
+			failed:  []string{a, b, c},
+			wantErr: "failed to roll back: 'svc/a/rollout.yml': failed to checkout commit: boom; the batch was aborted and no commit was created",
+		},
+		{
+			name:       "dry run",
+			opts:       Options{DryRun: true, SingleCommit: true},
+			batches:    [][]string{{a}, {b}, {c}},
+			rolledBack: []string{a, b, c},
+		},
+	}
+	for _, tt := range tests {
+		runner := &fakeRunner{respond: tt.repo.respond}
+		opts := tt.opts
+		opts.Runner = runner
+		var mu sync.Mutex
+		var batches [][]string
+		opts.OnCommit = func(rollbacks []FileRollback, commit string, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			var files []string
+			for _, r := range rollbacks {
+				files = append(files, r.File)
+			}
+			batches = append(batches, files)
+		}
+
+		result, err := Execute(&Plan{Rollbacks: rollbacks, opts: opts})
+		if (err == nil) != (tt.wantErr == "") || (err != nil && err.Error() != tt.wantErr) {
+			t.Errorf("%s: Execute() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if result == nil {
+			t.Fatalf("%s: Execute() returned no result", tt.name)
+		}
+		files := func(rollbacks []FileRollback) []string {
+			var files []string
+			for _, r := range rollbacks {
+				files = append(files, r.File)
+			}
+			slices.Sort(files)
+			return files
+		}
+		for _, check := range []struct {
+			what      string
+			got, want []string
+		}{
+			{"rolled back", files(result.RolledBack), tt.rolledBack},
+			{"unchanged", files(result.Unchanged), tt.unchanged},
+			{"failed", files(result.Failed), tt.failed},
+		} {
+			want := slices.Clone(check.want)
+			slices.Sort(want)
+			if !slices.Equal(check.got, want) {
+				t.Errorf("%s: Execute() %s %v, want %v", tt.name, check.what, check.got, want)
+			}
+		}
+		if opts.Jobs > 1 {
+			slices.SortFunc(batches, func(x, y []string) int { return strings.Compare(x[0], y[0]) })
+			slices.SortFunc(tt.batches, func(x, y []string) int { return strings.Compare(x[0], y[0]) })
+		}
+		if !reflect.DeepEqual(batches, tt.batches) {
+			t.Errorf("%s: Execute() called OnCommit with %v, want %v", tt.name, batches, tt.batches)
+		}
+		commits := 0
+		for _, call := range runner.calls {
+			if call[0] == "commit" {
+				commits++
+			}
+		}
+		if commits != tt.commits {
+			t.Errorf("%s: Execute() created %d commits, want %d", tt.name, commits, tt.commits)
+		}
+		if len(result.Commits) != len(tt.rolledBack) && !opts.DryRun {
+			t.Errorf("%s: Execute() recorded commits %v for %d files rolled back", tt.name, result.Commits, len(tt.rolledBack))
+		}
+	}
+}
+
+func TestExecuteDeleteNeedsBatch(t *testing.T) {
+	runner := &fakeRunner{respond: fakeRepo{}.respond}
+	plan := &Plan{Rollbacks: []FileRollback{{File: "svc/b/rollout.yaml", Commit: "0000001", Delete: true}}, opts: Options{Runner: runner}}
+	if _, err := Execute(plan); err == nil {
+		t.Error("Execute() deleted a file without SingleCommit or CommitPerDir")
+	}
+
+	plan.opts.SingleCommit = true
+	if _, err := Execute(plan); err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if !runner.ran("rm", "--quiet", "--", "svc/b/rollout.yaml") {
+		t.Errorf("Execute() did not delete the file: %q", runner.calls)
+	}
+}
@@ -0,0 +1,38 @@
+package rollback
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// runPostRollbackCmd runs Options.PostRollbackCmd for a file just restored
+// from commit, before it is committed. The file and commit are also passed
+// in the ROLLBACK_FILE and ROLLBACK_COMMIT environment variables, which need
+// no shell quoting.
+func runPostRollbackCmd(filePath string, commit string, opts Options) error {
+	if opts.PostRollbackCmd == "" {
+		return nil
+	}
+	tmpl, err := template.New("post-rollback").Parse(opts.PostRollbackCmd)
+	if err != nil {
+		return fmt.Errorf("invalid post-rollback command: %v", err)
+	}
+	var command strings.Builder
+	if err := tmpl.Execute(&command, messageData{File: filePath, Commit: commit}); err != nil {
+		return fmt.Errorf("failed to render the post-rollback command: %v", err)
+	}
+
+	cmd := exec.Command("sh", "-c", command.String())
+	cmd.Dir = opts.Dir
+	cmd.Env = append(os.Environ(), "ROLLBACK_FILE="+filePath, "ROLLBACK_COMMIT="+commit)
+	cmd.Stdout = opts.stdout()
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("post-rollback command failed for '%s': %v", filePath, err)
+	}
+
+	return nil
+}
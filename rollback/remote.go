@@ -0,0 +1,125 @@
+package rollback
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// Push pushes the branch to its upstream branch on the given remote. With
+// setUpstream the branch is pushed under its own name and set to track it;
+// otherwise a branch without an upstream is an error naming the git push -u
+// command to run instead.
+func Push(branch string, remote string, setUpstream bool, opts Options) error {
+	if branch == "" {
+		return fmt.Errorf("cannot push from a detached HEAD")
+	}
+	if opts.DryRun {
+		fmt.Fprintf(opts.stdout(), "[dry-run] Would push '%s' to %s\n", branch, remote)
+		return nil
+	}
+
+	if setUpstream {
+		output, err := opts.gitRetry("push", "-u", remote, branch)
+		opts.stdout().Write(output)
+		if err != nil {
+			return fmt.Errorf("failed to push '%s' to %s: %v", branch, remote, err)
+		}
+		return nil
+	}
+
+	merge, err := opts.git("config", "--get", "branch."+branch+".merge")
+	if err != nil {
+		return fmt.Errorf("branch '%s' has no upstream; push it with: git push -u %s %s", branch, remote, branch)
+	}
+
+	output, err := opts.gitRetry("push", remote, branch+":"+strings.TrimSpace(string(merge)))
+	opts.stdout().Write(output)
+	if err != nil {
+		return fmt.Errorf("failed to push '%s' to %s: %v", branch, remote, err)
+	}
+
+	return nil
+}
+
+// CreateBranch creates a branch at HEAD and switches to it, carrying over any
+// local changes.
+func CreateBranch(name string, opts Options) error {
+	if opts.DryRun {
+		fmt.Fprintf(opts.stdout(), "[dry-run] Would create and switch to branch '%s'\n", name)
+		return nil
+	}
+
+	output, err := opts.gitIndex("switch", "-c", name)
+	opts.stdout().Write(output)
+	if err != nil {
+		return fmt.Errorf("failed to create branch '%s': %v", name, err)
+	}
+
+	return nil
+}
+
+// CheckGitHubCLI reports an error if the GitHub CLI, which OpenPullRequest
+// uses, isn't installed or isn't logged in, so a rollback that is to open a
+// pull request can fail before anything is committed or pushed.
+func CheckGitHubCLI(opts Options) error {
+	output, err := opts.gh("auth", "status")
+	if errors.Is(err, exec.ErrNotFound) {
+		return fmt.Errorf("opening a pull request requires the GitHub CLI (gh); install it from https://cli.github.com")
+	} else if err != nil {
+		return fmt.Errorf("the GitHub CLI (gh) is not logged in; run 'gh auth login' or set GH_TOKEN: %v%s", err, indentOutput(output))
+	}
+
+	return nil
+}
+
+// indentOutput returns a command's output, if any, on lines of its own
+// below an error message.
+func indentOutput(output []byte) string {
+	text := strings.TrimSpace(string(output))
+	if text == "" {
+		return ""
+	}
+	return "\n  " + strings.ReplaceAll(text, "\n", "\n  ")
+}
+
+// OpenPullRequest opens a GitHub pull request for the pushed branch against
+// the remote's default branch, using the GitHub CLI (gh), and returns its
+// URL. The title comes from the commit message template for a single file,
+// and the body lists every file and its target commit. CheckGitHubCLI
+// checks beforehand that gh is ready to.
+func OpenPullRequest(branch string, remote string, rollbacks []FileRollback, opts Options) (string, error) {
+	headOut, err := opts.git("symbolic-ref", "--short", "refs/remotes/"+remote+"/HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to find the default branch of %s; set it with: git remote set-head %s --auto", remote, remote)
+	}
+	base := strings.TrimPrefix(strings.TrimSpace(string(headOut)), remote+"/")
+	if base == branch {
+		return "", fmt.Errorf("cannot open a pull request from '%s' into itself", branch)
+	}
+
+	title, body := batchCommitMessage(rollbacks), ""
+	if len(rollbacks) == 1 {
+		title, err = renderCommitMessage(rollbacks[0].File, rollbacks[0].Commit, opts)
+		if err != nil {
+			return "", err
+		}
+		body = fmt.Sprintf("- '%s' to commit %s\n", rollbacks[0].File, rollbacks[0].Commit)
+	} else {
+		title, body, _ = strings.Cut(title, "\n\n")
+	}
+	title, _, _ = strings.Cut(strings.TrimSpace(title), "\n")
+
+	if opts.DryRun {
+		fmt.Fprintf(opts.stdout(), "[dry-run] Would open a pull request from '%s' into '%s': %s\n", branch, base, title)
+		return "", nil
+	}
+
+	output, err := opts.gh("pr", "create", "--head", branch, "--base", base, "--title", title, "--body", body)
+	if err != nil {
+		return "", fmt.Errorf("failed to open a pull request: %v", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
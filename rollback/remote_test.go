@@ -0,0 +1,65 @@
+package rollback
+
+import (
+	"errors"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckGitHubCLI(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		wantErr string
+	}{
+		{name: "logged in"},
+		{name: "logged out", err: errors.New("exit status 1: You are not logged into any GitHub hosts"), wantErr: "not logged in; run 'gh auth login' or set GH_TOKEN"},
+		{name: "not installed", err: &exec.Error{Name: "gh", Err: exec.ErrNotFound}, wantErr: "requires the GitHub CLI (gh)"},
+	}
+	for _, tt := range tests {
+		runner := &fakeRunner{respond: func([]string) ([]byte, error) { return nil, tt.err }}
+		err := CheckGitHubCLI(Options{Runner: runner})
+		if (err == nil) != (tt.wantErr == "") || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+			t.Errorf("%s: CheckGitHubCLI() error = %v, want %q", tt.name, err, tt.wantErr)
+		}
+		if !runner.ran("gh", "auth", "status") {
+			t.Errorf("%s: CheckGitHubCLI() did not run gh auth status: %q", tt.name, runner.calls)
+		}
+	}
+
+	// A Runner that only runs git can't run gh.
+	if err := CheckGitHubCLI(Options{Runner: gitOnlyRunner{}}); err == nil {
+		t.Error("CheckGitHubCLI() accepted a Runner that cannot run gh")
+	}
+}
+
+// gitOnlyRunner is a Runner that isn't a CommandRunner.
+type gitOnlyRunner struct{}
+
+func (gitOnlyRunner) Run(args ...string) ([]byte, error) { return nil, nil }
+
+func TestOpenPullRequest(t *testing.T) {
+	runner := &fakeRunner{respond: func(args []string) ([]byte, error) {
+		switch args[0] {
+		case "symbolic-ref":
+			return []byte("origin/main\n"), nil
+		case "gh":
+			return []byte("https://github.com/o/r/pull/1\n"), nil
+		}
+		return nil, nil
+	}}
+	rollbacks := []FileRollback{{File: "a/rollout.yaml", Commit: "aaa1111"}, {File: "b/rollout.yaml", Commit: "aaa1111"}}
+	url, err := OpenPullRequest("rollback/x", "origin", rollbacks, Options{Runner: runner})
+	if err != nil {
+		t.Fatalf("OpenPullRequest() error = %v", err)
+	}
+	if url != "https://github.com/o/r/pull/1" {
+		t.Errorf("OpenPullRequest() = %q, want the URL gh printed", url)
+	}
+	want := []string{"gh", "pr", "create", "--head", "rollback/x", "--base", "main", "--title", "Rolled back 2 rollout files", "--body", "- 'a/rollout.yaml' to commit aaa1111\n- 'b/rollout.yaml' to commit aaa1111\n"}
+	if !slices.ContainsFunc(runner.calls, func(call []string) bool { return slices.Equal(call, want) }) {
+		t.Errorf("OpenPullRequest() ran %q, want %q", runner.calls, want)
+	}
+}
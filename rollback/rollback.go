@@ -0,0 +1,404 @@
+package rollback
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// ErrUnchanged is returned by RollbackFile when the file already matches the
+// target commit, so there is nothing to roll back.
+var ErrUnchanged = errors.New("file already matches that commit, nothing changed")
+
+type messageData struct {
+	File   string
+	Commit string
+}
+
+func renderCommitMessage(filePath string, commit string, opts Options) (string, error) {
+	tmpl, err := opts.messageTemplate()
+	if err != nil {
+		return "", fmt.Errorf("invalid message template: %v", err)
+	}
+
+	var buf strings.Builder
+	data := messageData{File: filePath, Commit: commit}
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render commit message: %v", err)
+	}
+
+	return buf.String(), nil
+}
+
+// hasStagedChanges reports whether the index differs from HEAD for any of
+// the files.
+func hasStagedChanges(opts Options, files ...string) (bool, error) {
+	// diff --quiet exits 1 when there are differences.
+	_, err := opts.gitIndex(append([]string{"diff", "--cached", "--quiet", "--"}, files...)...)
+	if err == nil {
+		return false, nil
+	} else if exitCode(err) != 1 {
+		return false, fmt.Errorf("failed to check for staged changes: %v", err)
+	}
+
+	return true, nil
+}
+
+// HasLocalChanges reports whether the file has staged or unstaged changes.
+func HasLocalChanges(filePath string, opts Options) (bool, error) {
+	output, err := opts.gitIndex("status", "--porcelain", "--", filePath)
+	if err != nil {
+		return false, fmt.Errorf("failed to check the status of '%s': %v", filePath, err)
+	}
+
+	return strings.TrimSpace(string(output)) != "", nil
+}
+
+func stashFile(filePath string, opts Options) error {
+	message := fmt.Sprintf("rollback: local changes to '%s'", filePath)
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	if _, err := opts.git("stash", "push", "-m", message, "--", filePath); err != nil {
+		return fmt.Errorf("failed to stash local changes: %v", err)
+	}
+
+	output, err := opts.git("rev-parse", "--short", "stash@{0}")
+	if err != nil {
+		return fmt.Errorf("failed to resolve the stash ref: %v", err)
+	}
+
+	fmt.Fprintf(opts.stdout(), "Stashed local changes to '%s' as stash@{0} (%s); restore them with 'git stash pop'.\n", filePath, strings.TrimSpace(string(output)))
+	return nil
+}
+
+// prepareWorkingTree refuses to touch a file with local changes unless they
+// can be stashed or Force is set.
+func prepareWorkingTree(filePath string, opts Options) error {
+	if opts.Force && !opts.Stash {
+		return nil
+	}
+
+	dirty, err := HasLocalChanges(filePath, opts)
+	if err != nil {
+		return err
+	}
+	if dirty && opts.Stash {
+		return stashFile(filePath, opts)
+	} else if dirty {
+		return fmt.Errorf("'%s' has uncommitted changes; commit or discard them first, or pass --stash or --force", filePath)
+	}
+
+	return nil
+}
+
+// checkoutFile restores the file from commit, or with Options.Patch only the
+// hunks the user picks.
+func checkoutFile(filePath string, commit string, opts Options) error {
+	if opts.Patch {
+		if err := opts.gitInteractive("checkout", "--patch", commit, "--", filePath); err != nil {
+			return fmt.Errorf("failed to checkout commit: %v", err)
+		}
+		return nil
+	}
+	output, err := opts.gitIndex("checkout", commit, "--", filePath)
+	opts.stdout().Write(output)
+	if err != nil {
+		return fmt.Errorf("failed to checkout commit: %v", err)
+	}
+
+	return nil
+}
+
+// checkRestored runs the checks on a file just restored from commit that
+// must pass before it is committed.
+func checkRestored(filePath string, commit string, opts Options) error {
+	if err := validateYAML(filePath, commit, opts); err != nil {
+		return err
+	}
+
+	return runPostRollbackCmd(filePath, commit, opts)
+}
+
+// RollbackFile restores the file to its content at the given commit, checks
+// it with ValidateYAML and PostRollbackCmd and, unless NoCommit is set, commits the result,
+// returning the new commit's full hash. It returns ErrUnchanged if the file
+// already matches the commit. It is safe to call concurrently for different
+// files.
+func RollbackFile(filePath string, commit string, opts Options) (string, error) {
+	// diff --quiet exits 1 when the versions differ.
+	if _, err := opts.git("diff", "--quiet", "HEAD", commit, "--", filePath); err == nil {
+		return "", ErrUnchanged
+	} else if exitCode(err) != 1 {
+		return "", fmt.Errorf("failed to compare '%s' with commit %s: %v", filePath, commit, err)
+	}
+
+	if opts.DryRun {
+		subject, err := CommitSubject(commit, opts)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(opts.stdout(), "[dry-run] Would roll back '%s' to commit %s (%s)\n", filePath, commit, subject)
+		return "", nil
+	}
+
+	if err := prepareWorkingTree(filePath, opts); err != nil {
+		return "", err
+	}
+
+	if opts.strategy() == "revert" {
+		return revertToCommit(filePath, commit, opts)
+	}
+
+	if err := checkoutFile(filePath, commit, opts); err != nil {
+		return "", err
+	}
+	if err := checkRestored(filePath, commit, opts); err != nil {
+		if _, resetErr := opts.gitIndex("checkout", "HEAD", "--", filePath); resetErr != nil {
+			return "", fmt.Errorf("%v (and failed to restore it to HEAD: %v)", err, resetErr)
+		}
+		return "", fmt.Errorf("%v; the file was restored to HEAD", err)
+	}
+
+	if opts.NoCommit {
+		fmt.Fprintf(opts.stdout(), "'%s' has been restored from commit %s and staged, but not committed.\n", filePath, commit)
+		return "", nil
+	}
+	if staged, err := hasStagedChanges(opts, filePath); err != nil {
+		return "", err
+	} else if !staged {
+		return "", ErrUnchanged
+	}
+
+	commitMessage, err := renderCommitMessage(filePath, commit, opts)
+	if err != nil {
+		return "", err
+	}
+	// HEAD is read under the same lock, before a concurrent rollback can
+	// commit on top.
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	output, err := opts.gitCommit("commit", "-m", commitMessage, "--", filePath)
+	opts.stdout().Write(output)
+	if err != nil {
+		// Left staged, the file would stop the next run as a local change.
+		// indexMu is already held.
+		if _, resetErr := opts.gitRetry("checkout", "HEAD", "--", filePath); resetErr != nil {
+			return "", fmt.Errorf("failed to create commit: %v (and failed to restore the file to HEAD: %v)", err, resetErr)
+		}
+		return "", fmt.Errorf("failed to create commit: %v; the file was restored to HEAD", err)
+	}
+
+	return opts.headHash()
+}
+
+// revertToCommit reverts, newest first, every commit after the given one that
+// touched the file. Each revert undoes the whole commit, not just the file.
+// It returns the hash of the last revert, or "" with NoCommit.
+func revertToCommit(filePath string, commit string, opts Options) (string, error) {
+	indexMu.Lock()
+	defer indexMu.Unlock()
+	output, err := opts.git("rev-list", commit+"..HEAD", "--", filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to list commits to revert: %v", err)
+	}
+
+	commits := strings.Fields(string(output))
+	for _, c := range commits {
+		args := []string{"revert", "--no-edit"}
+		if opts.NoCommit {
+			args = append(args, "--no-commit")
+		}
+		output, err := opts.gitCommit(append(args, c)...)
+		opts.stdout().Write(output)
+		if err != nil {
+			opts.git("revert", "--abort")
+			return "", fmt.Errorf("failed to revert commit %s (conflicts were aborted, no further commits reverted): %v", c, err)
+		}
+	}
+
+	if opts.NoCommit {
+		fmt.Fprintf(opts.stdout(), "Reverted %d commits for '%s' and staged the result, but did not commit.\n", len(commits), filePath)
+		return "", nil
+	}
+
+	return opts.headHash()
+}
+
+// headHash returns the full hash of HEAD, such as a commit just created.
+func (o Options) headHash() (string, error) {
+	output, err := o.git("rev-parse", "HEAD")
+	if err != nil {
+		return "", fmt.Errorf("failed to read the new commit: %v", err)
+	}
+
+	return strings.TrimSpace(string(output)), nil
+}
+
+// FileRollback pairs a file with the commit it should be restored to.
+// Delete marks a file that didn't exist at that commit, so RollbackFiles
+// removes it instead. Insertions and Deletions are the diffstat of the
+// rollback, as DiffStat counts it, when a saved plan records it.
+type FileRollback struct {
+	File       string `json:"file"`
+	Commit     string `json:"commit"`
+	Delete     bool   `json:"delete,omitempty"`
+	Insertions int    `json:"insertions"`
+	Deletions  int    `json:"deletions"`
+}
+
+// RollbackFiles checks out every file at its chosen commit, deleting those
+// marked Delete, and records them in one commit. If any step fails, the
+// files already restored are reset to HEAD so no partial commit is made. It
+// returns the new commit's full hash and the rollbacks left out of it
+// because their files already matched their commit, or ErrUnchanged,
+// without committing, if every file did.
+func RollbackFiles(rollbacks []FileRollback, opts Options) (string, []FileRollback, error) {
+	if opts.strategy() == "revert" {
+		return "", nil, fmt.Errorf("rolling back several files in one commit requires the checkout strategy")
+	}
+
+	var restored []string
+	abort := func(err error) error {
+		if len(restored) > 0 {
+			if _, resetErr := opts.gitIndex(append([]string{"checkout", "HEAD", "--"}, restored...)...); resetErr != nil {
+				return fmt.Errorf("%v (and failed to reset the files already restored: %v)", err, resetErr)
+			}
+		}
+		return fmt.Errorf("%v; the batch was aborted and no commit was created", err)
+	}
+
+	for _, r := range rollbacks {
+		if err := prepareWorkingTree(r.File, opts); err != nil {
+			return "", nil, abort(err)
+		}
+		if r.Delete {
+			if _, err := opts.gitIndex("rm", "--quiet", "--", r.File); err != nil {
+				return "", nil, abort(fmt.Errorf("failed to delete '%s': %v", r.File, err))
+			}
+		} else if err := checkoutFile(r.File, r.Commit, opts); err != nil {
+			return "", nil, abort(fmt.Errorf("'%s': %v", r.File, err))
+		}
+		restored = append(restored, r.File)
+	}
+	for _, r := range rollbacks {
+		if r.Delete {
+			continue
+		}
+		if err := checkRestored(r.File, r.Commit, opts); err != nil {
+			return "", nil, abort(err)
+		}
+	}
+
+	if opts.NoCommit {
+		fmt.Fprintf(opts.stdout(), "%d files have been restored and staged, but not committed.\n", len(rollbacks))
+		return "", nil, nil
+	}
+
+	var changed, unchanged []FileRollback
+	for _, r := range rollbacks {
+		if staged, err := hasStagedChanges(opts, r.File); err != nil {
+			return "", nil, abort(err)
+		} else if staged {
+			changed = append(changed, r)
+		} else {
+			unchanged = append(unchanged, r)
+		}
+	}
+	if len(changed) == 0 {
+		return "", unchanged, ErrUnchanged
+	}
+	files := make([]string, len(changed))
+	for i, r := range changed {
+		files[i] = r.File
+	}
+
+	message := batchCommitMessage(changed)
+	indexMu.Lock()
+	output, err := opts.gitCommit(append([]string{"commit", "-m", message, "--"}, files...)...)
+	var hash string
+	var headErr error
+	if err == nil {
+		hash, headErr = opts.headHash()
+	}
+	indexMu.Unlock()
+	opts.stdout().Write(output)
+	if err != nil {
+		return "", nil, abort(fmt.Errorf("failed to create commit: %v", err))
+	}
+
+	return hash, unchanged, headErr
+}
+
+// batchCommitMessage describes the rollbacks, naming the directory in the
+// subject when every file is in the same one, such as a service's.
+func batchCommitMessage(rollbacks []FileRollback) string {
+	dir := ""
+	for i, r := range rollbacks {
+		if i == 0 {
+			dir = filepath.Dir(r.File)
+		} else if filepath.Dir(r.File) != dir {
+			dir = ""
+			break
+		}
+	}
+
+	var message strings.Builder
+	files := "rollout files"
+	if len(rollbacks) == 1 {
+		files = "rollout file"
+	}
+	if dir != "" && dir != "." {
+		fmt.Fprintf(&message, "Rolled back %d %s in '%s'\n\n", len(rollbacks), files, filepath.ToSlash(dir))
+	} else {
+		fmt.Fprintf(&message, "Rolled back %d %s\n\n", len(rollbacks), files)
+	}
+	for _, r := range rollbacks {
+		if r.Delete {
+			fmt.Fprintf(&message, "- '%s' deleted, as it did not exist at commit %s\n", r.File, r.Commit)
+		} else {
+			fmt.Fprintf(&message, "- '%s' to commit %s\n", r.File, r.Commit)
+		}
+	}
+
+	return message.String()
+}
+
+// DiffStat returns the number of lines rolling the file back to commit
+// would insert and delete. Binary changes count as zero.
+func DiffStat(filePath string, commit string, opts Options) (int, int, error) {
+	output, err := opts.git("diff", "--numstat", "HEAD", commit, "--", filePath)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to compute diffstat: %v", err)
+	}
+
+	insertions, deletions := 0, 0
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		added, _ := strconv.Atoi(fields[0])
+		removed, _ := strconv.Atoi(fields[1])
+		insertions += added
+		deletions += removed
+	}
+
+	return insertions, deletions, nil
+}
+
+// ShowDiff writes the diff that rolling the file back to commit would apply.
+func ShowDiff(filePath string, commit string, opts Options) error {
+	args := []string{"diff"}
+	if opts.NoColor {
+		args = append(args, "--no-color")
+	}
+	output, err := opts.git(append(args, "HEAD", commit, "--", filePath)...)
+	opts.stdout().Write(output)
+	if err != nil {
+		return fmt.Errorf("failed to show diff: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package rollback
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRollbackFilesAbort(t *testing.T) {
+	rollbacks := []FileRollback{
+		{File: "a/rollout.yaml", Commit: "aaa1111"},
+		{File: "b/rollout.yaml", Commit: "bbb2222", Delete: true},
+		{File: "c/rollout.yaml", Commit: "ccc3333"},
+	}
+	tests := []struct {
+		name string
+		// fail is the command, up to its first path, that fails.
+		fail      []string
+		failReset bool
+		// reset are the files expected to be reset to HEAD, if any.
+		reset   []string
+		wantErr string
+	}{
+		{
+			name:    "first checkout fails",
+			fail:    []string{"checkout", "aaa1111"},
+			wantErr: "'a/rollout.yaml': failed to checkout commit: boom; the batch was aborted",
+		},
+		{
+			name:    "delete fails",
+			fail:    []string{"rm", "--quiet"},
+			reset:   []string{"a/rollout.yaml"},
+			wantErr: "failed to delete 'b/rollout.yaml': boom; the batch was aborted",
+		},
+		{
+			name:    "last checkout fails",
+			fail:    []string{"checkout", "ccc3333"},
+			reset:   []string{"a/rollout.yaml", "b/rollout.yaml"},
+			wantErr: "'c/rollout.yaml': failed to checkout commit: boom; the batch was aborted",
+		},
+		{
+			name:    "local changes",
+			fail:    []string{"status", "--porcelain"},
+			wantErr: "failed to check the status of 'a/rollout.yaml': boom; the batch was aborted",
+		},
+		{
+			name:      "reset fails",
+			fail:      []string{"checkout", "ccc3333"},
+			failReset: true,
+			reset:     []string{"a/rollout.yaml", "b/rollout.yaml"},
+			wantErr:   "failed to checkout commit: boom (and failed to reset the files already restored: reset failed)",
+		},
+	}
+	for _, tt := range tests {
+		runner := &fakeRunner{respond: func(args []string) ([]byte, error) {
+			if slices.Equal(args[:len(tt.fail)], tt.fail) {
+				return nil, errors.New("boom")
+			}
+			if tt.failReset && slices.Equal(args[:2], []string{"checkout", "HEAD"}) {
+				return nil, errors.New("reset failed")
+			}
+			return nil, nil
+		}}
+		hash, _, err := RollbackFiles(rollbacks, Options{Runner: runner})
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: RollbackFiles() = %q, %v, want error containing %q", tt.name, hash, err, tt.wantErr)
+		}
+		if tt.reset == nil {
+			if slices.ContainsFunc(runner.calls, func(call []string) bool { return call[0] == "checkout" && call[1] == "HEAD" }) {
+				t.Errorf("%s: RollbackFiles() reset files when none had been restored: %q", tt.name, runner.calls)
+			}
+		} else if !runner.ran(append([]string{"checkout", "HEAD", "--"}, tt.reset...)...) {
+			t.Errorf("%s: RollbackFiles() did not reset %q to HEAD: %q", tt.name, tt.reset, runner.calls)
+		}
+		if slices.ContainsFunc(runner.calls, func(call []string) bool { return call[0] == "commit" }) {
+			t.Errorf("%s: RollbackFiles() committed after failing: %q", tt.name, runner.calls)
+		}
+	}
+}
+
+func TestRollbackFilesRevert(t *testing.T) {
+	runner := &fakeRunner{}
+	_, _, err := RollbackFiles([]FileRollback{{File: "rollout.yaml", Commit: "aaa1111"}}, Options{Runner: runner, Strategy: "revert"})
+	if err == nil {
+		t.Error("RollbackFiles() accepted the revert strategy")
+	}
+	if len(runner.calls) > 0 {
+		t.Errorf("RollbackFiles() ran git with the revert strategy: %q", runner.calls)
+	}
+}
+
+func TestRollbackFilesLeavesOutUnchanged(t *testing.T) {
+	rollbacks := []FileRollback{
+		{File: "a/rollout.yaml", Commit: "aaa1111"},
+		{File: "b/rollout.yaml", Commit: "aaa1111"},
+	}
+	runner := &fakeRunner{respond: func(args []string) ([]byte, error) {
+		// Only a/rollout.yaml differs from HEAD once restored.
+		if slices.Equal(args, []string{"diff", "--cached", "--quiet", "--", "a/rollout.yaml"}) {
+			return nil, exitError(1)
+		}
+		return nil, nil
+	}}
+	_, unchanged, err := RollbackFiles(rollbacks, Options{Runner: runner})
+	if err != nil {
+		t.Fatalf("RollbackFiles() error = %v", err)
+	}
+	if !slices.Equal(unchanged, rollbacks[1:]) {
+		t.Errorf("RollbackFiles() unchanged = %v, want %v", unchanged, rollbacks[1:])
+	}
+	i := slices.IndexFunc(runner.calls, func(call []string) bool { return call[0] == "commit" })
+	if i < 0 {
+		t.Fatalf("RollbackFiles() did not commit: %q", runner.calls)
+	}
+	commit := runner.calls[i]
+	if want := []string{"--", "a/rollout.yaml"}; !slices.Equal(commit[len(commit)-2:], want) {
+		t.Errorf("RollbackFiles() committed %q, want only a/rollout.yaml", commit)
+	}
+	if message := commit[2]; strings.Contains(message, "b/rollout.yaml") {
+		t.Errorf("RollbackFiles() commit message names the unchanged file:\n%s", message)
+	}
+
+	runner.respond = nil
+	if _, unchanged, err := RollbackFiles(rollbacks, Options{Runner: runner}); !errors.Is(err, ErrUnchanged) || len(unchanged) != 2 {
+		t.Errorf("RollbackFiles() = %v, %v, want ErrUnchanged with both files", unchanged, err)
+	}
+}
+
+func TestRollbackFileCommitFails(t *testing.T) {
+	for _, failReset := range []bool{false, true} {
+		runner := &fakeRunner{respond: func(args []string) ([]byte, error) {
+			switch {
+			case args[0] == "diff":
+				return nil, exitError(1)
+			case args[0] == "commit":
+				return nil, errors.New("pre-commit hook failed")
+			case failReset && slices.Equal(args[:2], []string{"checkout", "HEAD"}):
+				return nil, errors.New("reset failed")
+			}
+			return nil, nil
+		}}
+		_, err := RollbackFile("rollout.yaml", "aaa1111", Options{Runner: runner})
+		want := "failed to create commit: pre-commit hook failed; the file was restored to HEAD"
+		if failReset {
+			want = "failed to create commit: pre-commit hook failed (and failed to restore the file to HEAD: reset failed)"
+		}
+		if err == nil || err.Error() != want {
+			t.Errorf("failReset=%v: RollbackFile() error = %v, want %q", failReset, err, want)
+		}
+		if !runner.ran("checkout", "HEAD", "--", "rollout.yaml") {
+			t.Errorf("failReset=%v: RollbackFile() did not restore the file to HEAD: %q", failReset, runner.calls)
+		}
+	}
+}
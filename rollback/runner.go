@@ -0,0 +1,176 @@
+package rollback
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runner runs git with the given arguments and returns its standard output.
+// Errors should include whatever git wrote to standard error and, when git
+// exits with a non-zero status, have an ExitCode method as *exec.ExitError
+// does, since some commands, such as git diff --quiet, answer with it.
+//
+// Every git operation goes through a Runner, so it is the seam for running
+// git some other way. The package deliberately keeps the git binary rather
+// than a pure Go implementation such as go-git: revert, stash, GPG signing,
+// approxidate parsing for --before, pathspec matching and push over the
+// user's configured credentials would all have to be reimplemented or
+// dropped, and rollback commits must match what git itself would create.
+type Runner interface {
+	Run(args ...string) ([]byte, error)
+}
+
+// execRunner runs the git binary found on PATH in dir, or in the working
+// directory if dir is empty. A positive timeout kills git, and anything it
+// started, once it has run that long. Unless prompts is set, git fails
+// instead of asking for credentials on a terminal nobody may be watching.
+type execRunner struct {
+	dir     string
+	timeout time.Duration
+	prompts bool
+}
+
+func (r execRunner) Run(args ...string) ([]byte, error) {
+	return r.RunCommand("git", args...)
+}
+
+// RunCommand runs another program, such as gh, as Run runs git.
+func (r execRunner) RunCommand(name string, args ...string) ([]byte, error) {
+	ctx := context.Background()
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = r.dir
+	if !r.prompts {
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ASKPASS=", "GH_PROMPT_DISABLED=1")
+	}
+	// A process group can't read the terminal, so git keeps the user's
+	// unless it has to be killed on a timeout and won't prompt anyway.
+	if r.timeout > 0 && !r.prompts {
+		killProcessGroup(cmd)
+	}
+	cmd.WaitDelay = time.Second
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if ctx.Err() == context.DeadlineExceeded {
+		return output, fmt.Errorf("%w: %s %s timed out after %s", err, name, args[0], r.timeout)
+	}
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return output, fmt.Errorf("%w: %s", err, msg)
+		}
+		return output, err
+	}
+
+	return output, nil
+}
+
+// CommandRunner is a Runner that can also run programs other than git, such
+// as the GitHub CLI (gh), which OpenPullRequest runs through it.
+type CommandRunner interface {
+	Runner
+	RunCommand(name string, args ...string) ([]byte, error)
+}
+
+// InteractiveRunner is a Runner that can also run git attached to the
+// terminal, for commands the user answers themselves such as
+// git checkout --patch. Options.Patch requires one.
+type InteractiveRunner interface {
+	Runner
+	RunInteractive(args ...string) error
+}
+
+// RunInteractive runs git with the terminal as its standard input and
+// output. There is no timeout, as the user may take their time.
+func (r execRunner) RunInteractive(args ...string) error {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = r.dir
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return cmd.Run()
+}
+
+// commandLine renders an invocation of git, or another command, for logs,
+// quoting arguments that contain whitespace or are empty.
+func commandLine(name string, args []string) string {
+	parts := []string{name}
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\x00") {
+			arg = strconv.Quote(arg)
+		}
+		parts = append(parts, arg)
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// exitCode returns the status git exited with, from an *exec.ExitError or any
+// other error with an ExitCode method, or -1 if it didn't exit on its own.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr interface{ ExitCode() int }
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+
+	return -1
+}
+
+// retryDelay is how long the first retry waits; each later one waits twice
+// as long as the one before.
+const retryDelay = 500 * time.Millisecond
+
+// transientPatterns mark git errors worth retrying: another process holding
+// a lock, or the network failing during a push.
+var transientPatterns = []string{
+	".lock': File exists",
+	"Could not resolve host",
+	"Connection timed out",
+	"Connection reset",
+	"Connection refused",
+	"The remote end hung up unexpectedly",
+	"early EOF",
+	"Operation timed out",
+}
+
+func isTransient(err error) bool {
+	for _, pattern := range transientPatterns {
+		if strings.Contains(err.Error(), pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// gitRetry runs git like Options.git, retrying up to Options.Retries times with
+// exponential backoff while it fails with a transient error.
+func (o Options) gitRetry(args ...string) ([]byte, error) {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		output, err := o.git(args...)
+		if err == nil || attempt >= o.Retries || !isTransient(err) {
+			return output, err
+		}
+		if o.Logger != nil {
+			o.Logger.Warn("retrying git after a transient failure", "command", commandLine("git", args), "attempt", attempt+1, "delay", delay, "error", err)
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package rollback
+
+import "os/exec"
+
+// killProcessGroup leaves cmd's default cancellation, which kills only git
+// itself, on platforms without process groups.
+func killProcessGroup(cmd *exec.Cmd) {}
@@ -0,0 +1,44 @@
+package rollback
+
+import "fmt"
+
+// CheckTag verifies that name is a valid tag name and, unless force is set,
+// that no such tag exists yet, so a rollback can fail before it starts.
+func CheckTag(name string, force bool, opts Options) error {
+	if _, err := opts.git("check-ref-format", "refs/tags/"+name); err != nil {
+		return fmt.Errorf("invalid tag name '%s'", name)
+	}
+	if force {
+		return nil
+	}
+	if _, err := opts.git("rev-parse", "--quiet", "--verify", "refs/tags/"+name); err == nil {
+		return fmt.Errorf("tag '%s' already exists; pass --force-tag to move it", name)
+	}
+
+	return nil
+}
+
+// TagRollback creates an annotated tag at HEAD whose message describes the
+// rollbacks it records. With force an existing tag is replaced.
+func TagRollback(name string, rollbacks []FileRollback, force bool, opts Options) error {
+	if opts.DryRun {
+		fmt.Fprintf(opts.stdout(), "[dry-run] Would tag the rollback as '%s'\n", name)
+		return nil
+	}
+
+	message := batchCommitMessage(rollbacks)
+	if len(rollbacks) == 1 {
+		message = fmt.Sprintf("Rolled back '%s' to commit %s\n", rollbacks[0].File, rollbacks[0].Commit)
+	}
+	args := []string{"tag", "--annotate", "--message", message}
+	if force {
+		args = append(args, "--force")
+	}
+	output, err := opts.git(append(args, name)...)
+	opts.stdout().Write(output)
+	if err != nil {
+		return fmt.Errorf("failed to create tag '%s': %v", name, err)
+	}
+
+	return nil
+}
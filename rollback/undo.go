@@ -0,0 +1,75 @@
+package rollback
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// singleCommitMessagePattern matches the subject RollbackFiles writes,
+// which names the directory when all the files share one.
+var singleCommitMessagePattern = regexp.MustCompile(`^Rolled back \d+ rollout files?( in '[^'\n]+')?\n`)
+
+// IsRollbackCommitMessage reports whether a commit message was produced by
+// this package, either with the default message, the Message template or the
+// RollbackFiles summary.
+func IsRollbackCommitMessage(message string, opts Options) bool {
+	message = strings.TrimSpace(message)
+	if strings.HasPrefix(message, "Successfully rolled back ") || singleCommitMessagePattern.MatchString(message) {
+		return true
+	}
+
+	const filePlaceholder, commitPlaceholder = "\x00file\x00", "\x00commit\x00"
+	rendered, err := renderCommitMessage(filePlaceholder, commitPlaceholder, opts)
+	if err != nil {
+		return false
+	}
+	pattern := regexp.QuoteMeta(strings.TrimSpace(rendered))
+	pattern = strings.ReplaceAll(pattern, filePlaceholder, ".+")
+	pattern = strings.ReplaceAll(pattern, commitPlaceholder, "[0-9a-f]+")
+	re, err := regexp.Compile("(?s)^" + pattern + "$")
+	if err != nil {
+		return false
+	}
+	return re.MatchString(message) || re.MatchString(withoutTrailers(message))
+}
+
+// withoutTrailers returns the message without its last paragraph if that is
+// a block of "Key: value" trailers, such as Options.Trailers adds.
+func withoutTrailers(message string) string {
+	i := strings.LastIndex(message, "\n\n")
+	if i < 0 {
+		return message
+	}
+	for _, line := range strings.Split(message[i+2:], "\n") {
+		if !trailerPattern.MatchString(line) {
+			return message
+		}
+	}
+
+	return strings.TrimSpace(message[:i])
+}
+
+// LatestCommit returns the abbreviated hash and full message of HEAD.
+func LatestCommit(opts Options) (string, string, error) {
+	output, err := opts.git("log", "-1", "--pretty=format:%h%x00%B")
+	if err != nil {
+		return "", "", fmt.Errorf("failed to read the latest commit: %v", err)
+	}
+
+	hash, message, _ := strings.Cut(string(output), "\x00")
+	return hash, message, nil
+}
+
+// RevertCommit creates a commit reverting the given one.
+func RevertCommit(hash string, opts Options) error {
+	indexMu.Lock()
+	output, err := opts.gitCommit("revert", "--no-edit", hash)
+	indexMu.Unlock()
+	opts.stdout().Write(output)
+	if err != nil {
+		return fmt.Errorf("failed to revert commit: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,32 @@
+package rollback
+
+import "testing"
+
+func TestIsRollbackCommitMessage(t *testing.T) {
+	custom := "chore(rollout): restore {{.File}} to {{.Commit}}"
+	tests := []struct {
+		name    string
+		message string
+		opts    Options
+		want    bool
+	}{
+		{name: "default", message: "Successfully rolled back 'svc/rollout.yaml' to commit abc1234\n", want: true},
+		{name: "default with trailers", message: "Successfully rolled back 'svc/rollout.yaml' to commit abc1234\n\nTicket: OPS-1\n", want: true},
+		{name: "batch", message: "Rolled back 3 rollout files\n\n- 'a/rollout.yaml' to commit abc1234\n", want: true},
+		{name: "batch of one", message: "Rolled back 1 rollout file\n\n- 'a/rollout.yaml' to commit abc1234\n", want: true},
+		{name: "per directory", message: "Rolled back 2 rollout files in 'svc/a'\n\n- 'svc/a/rollout.yaml' to commit abc1234\n", want: true},
+		{name: "subject only", message: "Rolled back 3 rollout files", want: false},
+		{name: "other commit", message: "Bump replicas to 3\n", want: false},
+		{name: "custom", message: "chore(rollout): restore svc/rollout.yaml to abc1234", opts: Options{Message: custom}, want: true},
+		{name: "custom with trailers", message: "chore(rollout): restore svc/rollout.yaml to abc1234\n\nTicket: OPS-1\nSigned-off-by: Jane <j@example.com>\n", opts: Options{Message: custom}, want: true},
+		{name: "custom with a body", message: "chore(rollout): restore svc/rollout.yaml to abc1234\n\nBecause it broke.\n", opts: Options{Message: custom}, want: false},
+		{name: "custom bad hash", message: "chore(rollout): restore svc/rollout.yaml to HEAD", opts: Options{Message: custom}, want: false},
+		{name: "custom not matching", message: "chore(deps): bump yaml", opts: Options{Message: custom}, want: false},
+		{name: "invalid template", message: "chore(deps): bump yaml", opts: Options{Message: "{{.File"}, want: false},
+	}
+	for _, tt := range tests {
+		if got := IsRollbackCommitMessage(tt.message, tt.opts); got != tt.want {
+			t.Errorf("%s: IsRollbackCommitMessage(%q) = %v, want %v", tt.name, tt.message, got, tt.want)
+		}
+	}
+}
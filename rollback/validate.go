@@ -0,0 +1,36 @@
+package rollback
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v3"
+)
+
+// validateYAML checks, with Options.ValidateYAML, that a file just restored
+// from commit parses as YAML. Every document in the file is checked.
+func validateYAML(filePath string, commit string, opts Options) error {
+	if !opts.ValidateYAML {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(opts.Dir, filePath))
+	if err != nil {
+		return fmt.Errorf("failed to read '%s' for validation: %v", filePath, err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	for {
+		var doc yaml.Node
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("'%s' at commit %s is not valid YAML: %v", filePath, commit, err)
+		}
+	}
+}